@@ -0,0 +1,100 @@
+package logrustash
+
+import (
+	"math"
+	"net"
+	"time"
+)
+
+// BackoffStrategy decides when the hook resends messages and reconnects to logstash
+// and how long it waits before each reconnect attempt.
+type BackoffStrategy interface {
+	// NextDelay returns delay before reconnect attempt. The first attempt is 0.
+	NextDelay(attempt int) time.Duration
+	// ShouldRetry reports whether the message should be resent over the current connection
+	// after err. attempt is the number of resends done.
+	ShouldRetry(err error, attempt int) bool
+	// ShouldReconnect reports whether reconnect attempt should be made. For the first attempt
+	// err is the send error, for the next ones it is the error of the previous attempt.
+	ShouldReconnect(err error, attempt int) bool
+}
+
+// ErrorClass declares how the hook handles an error of sending message.
+type ErrorClass int
+
+// Error classes.
+const (
+	ErrorRetryable ErrorClass = iota // Message is resent over the current connection.
+	ErrorReconnect                   // Connection is replaced and message is resent over the new one.
+	ErrorFatal                       // Message is dropped.
+)
+
+// DefaultClassifyError classifies temporary and timeout net errors as retryable, other net errors as requiring reconnect
+// and the rest as fatal.
+func DefaultClassifyError(err error) ErrorClass {
+	netErr, ok := err.(net.Error)
+	switch {
+	case !ok:
+		return ErrorFatal
+	case netErr.Temporary() || netErr.Timeout():
+		return ErrorRetryable
+	default:
+		return ErrorReconnect
+	}
+}
+
+// ExponentialBackoff is the default strategy. It resends messages on retryable errors
+// and reconnects on errors requiring reconnect with delay growing as BaseDelay * Multiplier^attempt.
+// Errors are classified by DefaultClassifyError.
+type ExponentialBackoff struct {
+	BaseDelay           time.Duration // First reconnect delay.
+	Multiplier          float64       // Base multiplier for delay before reconnect.
+	MaxSendRetries      int           // Declares how many times we will try to resend message.
+	MaxReconnectRetries int           // Declares how many times we will try to reconnect.
+}
+
+// NextDelay implements BackoffStrategy.
+func (b ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	return time.Duration(float64(b.BaseDelay) * math.Pow(b.Multiplier, float64(attempt)))
+}
+
+// ShouldRetry implements BackoffStrategy.
+func (b ExponentialBackoff) ShouldRetry(err error, attempt int) bool {
+	return b.shouldRetry(DefaultClassifyError(err), attempt)
+}
+
+func (b ExponentialBackoff) shouldRetry(class ErrorClass, attempt int) bool {
+	return class == ErrorRetryable && attempt < b.MaxSendRetries
+}
+
+// ShouldReconnect implements BackoffStrategy.
+func (b ExponentialBackoff) ShouldReconnect(err error, attempt int) bool {
+	return b.shouldReconnect(DefaultClassifyError(err), attempt)
+}
+
+func (b ExponentialBackoff) shouldReconnect(class ErrorClass, attempt int) bool {
+	if attempt > b.MaxReconnectRetries {
+		// We have reached limit of re-connections.
+		return false
+	}
+
+	if attempt == 0 {
+		return class == ErrorReconnect && b.MaxReconnectRetries > 0
+	}
+
+	return true
+}
+
+// classifiedBackoff is ExponentialBackoff with custom error classification.
+type classifiedBackoff struct {
+	ExponentialBackoff
+	classify func(error) ErrorClass
+}
+
+func (b classifiedBackoff) ShouldRetry(err error, attempt int) bool {
+	return b.shouldRetry(b.classify(err), attempt)
+}
+
+func (b classifiedBackoff) ShouldReconnect(err error, attempt int) bool {
+	return b.shouldReconnect(b.classify(err), attempt)
+}
@@ -0,0 +1,45 @@
+package logrustash
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{BaseDelay: time.Second, Multiplier: 2, MaxSendRetries: 1, MaxReconnectRetries: 2}
+
+	if delay := b.NextDelay(3); delay != 8*time.Second {
+		t.Errorf("expected delay to be '%s' but got '%s'", 8*time.Second, delay)
+	}
+	if !b.ShouldRetry(netErrorMock{temporary: true}, 0) || b.ShouldRetry(netErrorMock{temporary: true}, 1) {
+		t.Error("expected temporary error to be retried once")
+	}
+	if b.ShouldRetry(fmt.Errorf("generic error"), 0) {
+		t.Error("expected generic error to not be retried")
+	}
+	if !b.ShouldReconnect(netErrorMock{}, 0) || b.ShouldReconnect(netErrorMock{temporary: true}, 0) {
+		t.Error("expected reconnect only on not temporary error")
+	}
+	if !b.ShouldReconnect(fmt.Errorf("dial error"), 2) || b.ShouldReconnect(fmt.Errorf("dial error"), 3) {
+		t.Error("expected reconnect attempts to be limited by MaxReconnectRetries")
+	}
+}
+
+func TestDefaultClassifyError(t *testing.T) {
+	tt := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{netErrorMock{temporary: true, timeout: true}, ErrorRetryable},
+		{netErrorMock{timeout: true}, ErrorRetryable},
+		{netErrorMock{}, ErrorReconnect},
+		{fmt.Errorf("generic error"), ErrorFatal},
+	}
+
+	for _, te := range tt {
+		if class := DefaultClassifyError(te.err); class != te.expected {
+			t.Errorf("expected %v to be classified as %d but got %d", te.err, te.expected, class)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package logrustash
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CEFFormatter generates lines in ArcSight Common Event Format (CEF):
+// CEF:0|Vendor|Product|Version|SignatureID|Name|Severity|Extension
+// The rt extension is set from the entry time unless the entry has rt field: its value is kept.
+type CEFFormatter struct {
+	Vendor  string // Device Vendor header field.
+	Product string // Device Product header field.
+	Version string // Device Version header field.
+
+	// SignatureIDKey names the entry field used as the Signature ID.
+	// The level name is used if it is empty or the entry doesn't have such field.
+	SignatureIDKey string
+}
+
+// Format formats log message.
+func (f *CEFFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return f.FormatWithPrefix(entry, "")
+}
+
+// FormatWithPrefix removes prefix from keys and formats log message.
+func (f *CEFFormatter) FormatWithPrefix(entry *logrus.Entry, prefix string) ([]byte, error) {
+	signatureID := entry.Level.String()
+	extension := make(map[string]string, len(entry.Data)+1)
+	for k, v := range entry.Data {
+		if f.SignatureIDKey != "" && k == f.SignatureIDKey {
+			signatureID = fmt.Sprint(v)
+			continue
+		}
+
+		// Remove the prefix when sending the fields to logstash
+		k, ok := trimPrefix(entry.Data, k, prefix)
+		if !ok {
+			continue
+		}
+
+		switch v := v.(type) {
+		case error:
+			extension[k] = v.Error()
+		default:
+			extension[k] = fmt.Sprint(v)
+		}
+	}
+
+	// rt is the CEF receipt time in milliseconds since epoch. The rt field of the entry wins.
+	if _, ok := extension["rt"]; !ok {
+		extension["rt"] = strconv.FormatInt(entry.Time.UnixNano()/1e6, 10)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("CEF:0|")
+	b.WriteString(cefEscapeHeader(f.Vendor))
+	b.WriteByte('|')
+	b.WriteString(cefEscapeHeader(f.Product))
+	b.WriteByte('|')
+	b.WriteString(cefEscapeHeader(f.Version))
+	b.WriteByte('|')
+	b.WriteString(cefEscapeHeader(signatureID))
+	b.WriteByte('|')
+	b.WriteString(cefEscapeHeader(entry.Message))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(cefSeverity(entry.Level)))
+	b.WriteByte('|')
+
+	keys := make([]string, 0, len(extension))
+	for k := range extension {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(cefKeyReplacer.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(cefEscapeExtension(extension[k]))
+	}
+	b.WriteByte('\n')
+
+	return b.Bytes(), nil
+}
+
+// cefSeverity maps logrus levels to CEF severity (0 is the lowest and 10 is the highest).
+func cefSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 10
+	case logrus.FatalLevel:
+		return 9
+	case logrus.ErrorLevel:
+		return 7
+	case logrus.WarnLevel:
+		return 5
+	case logrus.InfoLevel:
+		return 3
+	default:
+		return 1
+	}
+}
+
+var (
+	cefHeaderReplacer    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtensionReplacer = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+	cefKeyReplacer       = strings.NewReplacer(" ", "_", "=", "_", "|", "_", `\`, "_", "\r", "_", "\n", "_")
+)
+
+// cefEscapeHeader escapes pipes and backslashes in header fields. Newlines aren't allowed there at all.
+func cefEscapeHeader(s string) string {
+	return cefHeaderReplacer.Replace(s)
+}
+
+// cefEscapeExtension escapes equal signs, backslashes and newlines in extension values.
+func cefEscapeExtension(s string) string {
+	return cefExtensionReplacer.Replace(s)
+}
@@ -0,0 +1,103 @@
+package logrustash
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCEFFormatter(t *testing.T) {
+	cf := CEFFormatter{Vendor: "Acme", Product: "Shop|Front", Version: "1.0"}
+
+	entry := &logrus.Entry{
+		Message: "user logged in",
+		Level:   logrus.ErrorLevel,
+		Time:    time.Unix(1500000000, 0),
+		Data: logrus.Fields{
+			"user":  "bob",
+			"query": "a=b\\c\nd",
+			"error": fmt.Errorf("failed"),
+		},
+	}
+
+	b, err := cf.Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	expected := `CEF:0|Acme|Shop\|Front|1.0|error|user logged in|7|` +
+		`error=failed query=a\=b\\c\nd rt=1500000000000 user=bob` + "\n"
+	if string(b) != expected {
+		t.Errorf("expected CEF line to be '%s' but got '%s'", expected, b)
+	}
+}
+
+func TestCEFFormatterReceiptTimeField(t *testing.T) {
+	cf := CEFFormatter{Vendor: "Acme", Product: "Shop", Version: "1.0"}
+
+	entry := &logrus.Entry{
+		Message: "login",
+		Level:   logrus.InfoLevel,
+		Time:    time.Unix(1500000000, 0),
+		Data:    logrus.Fields{"rt": 1400000000000},
+	}
+
+	b, err := cf.Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	if !strings.HasSuffix(string(b), "|rt=1400000000000\n") {
+		t.Errorf("expected rt field of the entry to be kept but got '%s'", b)
+	}
+}
+
+func TestCEFFormatterSignatureID(t *testing.T) {
+	cf := CEFFormatter{Vendor: "Acme", Product: "Shop", Version: "1.0", SignatureIDKey: "event"}
+
+	entry := &logrus.Entry{
+		Message: "login",
+		Level:   logrus.InfoLevel,
+		Data:    logrus.Fields{"event": "auth:100", "_user": "bob"},
+	}
+
+	b, err := cf.FormatWithPrefix(entry, "_")
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	header := strings.SplitN(string(b), "|", 8)
+	if len(header) != 8 {
+		t.Fatalf("expected CEF line to have 8 parts but got %d: '%s'", len(header), b)
+	}
+	if header[4] != "auth:100" {
+		t.Errorf("expected signature ID to be '%s' but got '%s'", "auth:100", header[4])
+	}
+	if header[6] != "3" {
+		t.Errorf("expected severity to be '%s' but got '%s'", "3", header[6])
+	}
+	if !strings.Contains(header[7], " user=bob") || strings.Contains(header[7], "event=") {
+		t.Errorf("expected extension to have trimmed user key and no event key but got '%s'", header[7])
+	}
+}
+
+func TestFireWithCEFFormatter(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		Formatter:        &CEFFormatter{Vendor: "Acme", Product: "Shop", Version: "1.0"},
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}, Level: logrus.WarnLevel}); err != nil {
+		t.Error(err)
+	}
+
+	if res := conn.buff.String(); !strings.HasPrefix(res, "CEF:0|Acme|Shop|1.0|warning|hello|5|") {
+		t.Errorf("expected CEF line to be written to conn but got '%s'", res)
+	}
+}
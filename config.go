@@ -0,0 +1,181 @@
+package logrustash
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config holds options of a hook created by New. It covers the common options and those which affect
+// the first connection, the rest are set with Hook fields after New.
+type Config struct {
+	Protocol                 string           // Protocol of logstash, e.g. tcp, udp or tls. Ignored if Conn is set.
+	Address                  string           // Address of logstash, e.g. logstash:5000. Ignored if Conn is set.
+	Conn                     net.Conn         // Connection to use instead of dialing. Without Conn and address the hook only filters entries.
+	LazyConnect              bool             // Dial on the first send instead of in New, so the service starts while logstash is down.
+	Dialer                   *net.Dialer      // Dials logstash and reconnects, e.g. with FallbackDelay racing IPv6 and IPv4, see Hook.Dialer.
+	AppName                  string           // Sent as type of messages.
+	Fields                   logrus.Fields    // Sent with every message.
+	Prefix                   string           // Prefix of fields which are sent without it, other fields aren't sent.
+	Async                    bool             // Send messages asynchronously.
+	AsyncBufferSize          int              // Size of async buffer. Defaults to 8192.
+	WaitUntilBufferFrees     bool             // Wait instead of dropping messages when async buffer is full.
+	MaxBufferAge             time.Duration    // Drop messages which waited in async buffer longer than this.
+	DeliveryMode             DeliveryMode     // Delivery semantics, e.g. AtLeastOnce. BestEffort by default.
+	SpillDir                 string           // Directory where messages are saved instead of being dropped, see Hook.SpillDir.
+	Timeout                  time.Duration    // Timeout for sending message.
+	MaxSendRetries           int              // Declares how many times we will try to resend message.
+	RetryBudget              time.Duration    // Limits total time of resending and reconnecting for a single send.
+	ReconnectBaseDelay       time.Duration    // First reconnect delay.
+	ReconnectDelayMultiplier float64          // Base multiplier for delay before reconnect.
+	MaxReconnectRetries      int              // Declares how many times we will try to reconnect.
+	Backoff                  BackoffStrategy  // Overrides the resend and reconnect options above if it is set.
+	HealthCheckInterval      time.Duration    // Probe the connection in background with this interval, see StartHealthCheck.
+	IdleTimeout              time.Duration    // Close the connection after no messages were sent for this long.
+	SummaryInterval          time.Duration    // Send summary of fired entries with this interval, see StartSummary.
+	Formatter                logrus.Formatter // Formats entries before sending. LogstashFormatter is used if it is nil.
+	Framing                  Framing          // How messages are delimited. Newline by default.
+	Compress                 bool             // Gzip each message inside its frame, requires LengthPrefixFraming.
+	CompressMinSize          int              // Messages smaller than this many bytes are sent uncompressed.
+	TimeFormat               string           // Format of timestamps.
+	SendAttemptsKey          string           // Adds field with the number of attempts it took to send the entry, see Hook.SendAttemptsKey.
+	ConnectHeader            []byte           // Written to each new connection before the first message, including the one dialed by New.
+}
+
+// New creates a new hook from cfg. It dials logstash unless cfg.Conn or cfg.LazyConnect is set.
+// Zero value of Config makes a sync hook which doesn't forward to logstash, like NewFilterHook.
+func New(cfg Config) (*Hook, error) {
+	if cfg.DeliveryMode == AtLeastOnce && cfg.SpillDir == "" {
+		return nil, fmt.Errorf("SpillDir must be set for AtLeastOnce delivery mode")
+	}
+	if cfg.Compress && cfg.Framing != LengthPrefixFraming {
+		return nil, fmt.Errorf("Compress requires LengthPrefixFraming, gzip output may contain newlines")
+	}
+
+	fields := cfg.Fields
+	if fields == nil {
+		fields = make(logrus.Fields)
+	}
+
+	hook := &Hook{
+		conn:                     cfg.Conn,
+		Dialer:                   cfg.Dialer,
+		created:                  time.Now(),
+		appName:                  cfg.AppName,
+		alwaysSentFields:         fields,
+		hookOnlyPrefix:           cfg.Prefix,
+		WaitUntilBufferFrees:     cfg.WaitUntilBufferFrees,
+		MaxBufferAge:             cfg.MaxBufferAge,
+		DeliveryMode:             cfg.DeliveryMode,
+		SpillDir:                 cfg.SpillDir,
+		Timeout:                  cfg.Timeout,
+		MaxSendRetries:           cfg.MaxSendRetries,
+		RetryBudget:              cfg.RetryBudget,
+		ReconnectBaseDelay:       cfg.ReconnectBaseDelay,
+		ReconnectDelayMultiplier: cfg.ReconnectDelayMultiplier,
+		MaxReconnectRetries:      cfg.MaxReconnectRetries,
+		Backoff:                  cfg.Backoff,
+		HealthCheckInterval:      cfg.HealthCheckInterval,
+		IdleTimeout:              cfg.IdleTimeout,
+		SummaryInterval:          cfg.SummaryInterval,
+		Formatter:                cfg.Formatter,
+		Framing:                  cfg.Framing,
+		Compress:                 cfg.Compress,
+		CompressMinSize:          cfg.CompressMinSize,
+		TimeFormat:               cfg.TimeFormat,
+		SendAttemptsKey:          cfg.SendAttemptsKey,
+		ConnectHeader:            cfg.ConnectHeader,
+	}
+
+	if cfg.Conn == nil && (cfg.Protocol != "" || cfg.Address != "") {
+		if cfg.Protocol == "" || cfg.Address == "" {
+			return nil, fmt.Errorf("Both protocol and address of logstash must be set")
+		}
+
+		hook.protocol = cfg.Protocol
+		hook.address = cfg.Address
+
+		if cfg.LazyConnect {
+			hook.idle = true
+		} else {
+			conn, err := hook.dial()
+			if err != nil {
+				return nil, err
+			}
+			hook.Lock()
+			err = hook.startConn(conn)
+			hook.Unlock()
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if cfg.Async {
+		hook.AsyncBufferSize = 8192
+		if cfg.AsyncBufferSize > 0 {
+			hook.AsyncBufferSize = cfg.AsyncBufferSize
+		}
+		hook.makeAsync()
+	}
+
+	hook.StartHealthCheck()
+	hook.StartSummary()
+
+	return hook, nil
+}
+
+// Config returns snapshot of the hook settings, e.g. to dump effective configuration.
+// Conn is set only for hooks created with own connection, others report protocol and address of logstash.
+func (h *Hook) Config() Config {
+	h.RLock()
+	defer h.RUnlock()
+
+	fields := make(logrus.Fields, len(h.alwaysSentFields))
+	for k, v := range h.alwaysSentFields {
+		fields[k] = v
+	}
+
+	cfg := Config{
+		Protocol:                 h.protocol,
+		Address:                  h.address,
+		LazyConnect:              h.idle && h.conn == nil,
+		Dialer:                   h.Dialer,
+		AppName:                  h.appName,
+		Fields:                   fields,
+		Prefix:                   h.hookOnlyPrefix,
+		Async:                    h.fireChannel != nil,
+		WaitUntilBufferFrees:     h.WaitUntilBufferFrees,
+		MaxBufferAge:             h.MaxBufferAge,
+		DeliveryMode:             h.DeliveryMode,
+		SpillDir:                 h.SpillDir,
+		Timeout:                  h.Timeout,
+		MaxSendRetries:           h.MaxSendRetries,
+		RetryBudget:              h.RetryBudget,
+		ReconnectBaseDelay:       h.ReconnectBaseDelay,
+		ReconnectDelayMultiplier: h.ReconnectDelayMultiplier,
+		MaxReconnectRetries:      h.MaxReconnectRetries,
+		Backoff:                  h.Backoff,
+		HealthCheckInterval:      h.HealthCheckInterval,
+		IdleTimeout:              h.IdleTimeout,
+		SummaryInterval:          h.SummaryInterval,
+		Formatter:                h.Formatter,
+		Framing:                  h.Framing,
+		Compress:                 h.Compress,
+		CompressMinSize:          h.CompressMinSize,
+		TimeFormat:               h.TimeFormat,
+		SendAttemptsKey:          h.SendAttemptsKey,
+		ConnectHeader:            h.ConnectHeader,
+	}
+	if h.protocol == "" && h.address == "" {
+		cfg.Conn = h.conn
+	}
+	if cfg.Async {
+		cfg.AsyncBufferSize = cap(h.fireChannel)
+	}
+
+	return cfg
+}
@@ -0,0 +1,294 @@
+package logrustash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestNew(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b := make([]byte, 1024)
+		n, _ := conn.Read(b)
+		received <- b[:n]
+	}()
+
+	backoff := ExponentialBackoff{BaseDelay: time.Millisecond}
+	hook, err := New(Config{
+		Protocol:                 "tcp",
+		Address:                  ln.Addr().String(),
+		AppName:                  "bob",
+		Fields:                   logrus.Fields{"env": "test"},
+		Prefix:                   "_",
+		Async:                    true,
+		AsyncBufferSize:          4,
+		WaitUntilBufferFrees:     true,
+		MaxBufferAge:             time.Minute,
+		Timeout:                  2 * time.Second,
+		MaxSendRetries:           3,
+		ReconnectBaseDelay:       time.Second,
+		ReconnectDelayMultiplier: 2,
+		MaxReconnectRetries:      5,
+		Backoff:                  backoff,
+		Formatter:                &LogstashFormatter{Type: "custom"},
+		Framing:                  NewlineFraming,
+		TimeFormat:               time.RFC3339,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+
+	if hook.protocol != "tcp" || hook.address != ln.Addr().String() || hook.appName != "bob" || hook.hookOnlyPrefix != "_" {
+		t.Errorf("expected hook to have connection options but got %s://%s, app name '%s' and prefix '%s'",
+			hook.protocol, hook.address, hook.appName, hook.hookOnlyPrefix)
+	}
+	if cap(hook.fireChannel) != 4 || !hook.WaitUntilBufferFrees || hook.MaxBufferAge != time.Minute {
+		t.Errorf("expected hook to have async options but got buffer size %d", cap(hook.fireChannel))
+	}
+	if hook.Timeout != 2*time.Second || hook.MaxSendRetries != 3 || hook.ReconnectBaseDelay != time.Second ||
+		hook.ReconnectDelayMultiplier != 2 || hook.MaxReconnectRetries != 5 || hook.Backoff != backoff {
+		t.Errorf("expected hook to have retry options but got %+v", hook)
+	}
+	if hook.TimeFormat != time.RFC3339 {
+		t.Errorf("expected time format to be '%s' but got '%s'", time.RFC3339, hook.TimeFormat)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{"_user": "alice"}}); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case b := <-received:
+		var res map[string]string
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res["message"] != "hello" || res["type"] != "custom" || res["env"] != "test" || res["user"] != "alice" {
+			t.Errorf("expected message to be sent with configured fields but got '%s'", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected message to be sent to logstash")
+	}
+
+	if _, err := New(Config{Protocol: "tcp"}); err == nil {
+		t.Error("expected hook to not be created without address")
+	}
+}
+
+func TestNewZeroConfig(t *testing.T) {
+	hook, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hook.conn != nil || hook.fireChannel != nil || hook.alwaysSentFields == nil {
+		t.Errorf("expected sync filter hook but got %+v", hook)
+	}
+
+	if hook.hookOnlyPrefix != "" || hook.appName != "" || hook.Formatter != nil || hook.Framing != NewlineFraming {
+		t.Errorf("expected hook to have default options but got %+v", hook)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+		t.Errorf("expected fire to not return error: %s", err)
+	}
+}
+
+func TestNewLazyConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close() // Nothing listens on the address, so dialing in New would fail.
+
+	hook, err := New(Config{Protocol: "tcp", Address: address, AppName: "bob", LazyConnect: true})
+	if err != nil {
+		t.Fatalf("expected hook to be created without dialing but got: %s", err)
+	}
+	defer hook.Close()
+
+	var dials int
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook.dialFunc = func(protocol, address string) (net.Conn, error) {
+		dials++
+		return conn, nil
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.Fire(&logrus.Entry{Message: "again"}); err != nil {
+		t.Fatal(err)
+	}
+	if dials != 1 {
+		t.Errorf("expected the first fire to dial once but got %d dials", dials)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "hello" || res["type"] != "bob" {
+		t.Errorf("expected message to be sent after lazy connect but got '%v'", res)
+	}
+}
+
+func TestNewWithDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	var dials []string
+	dialer := &net.Dialer{
+		FallbackDelay: 50 * time.Millisecond,
+		Control: func(network, address string, c syscall.RawConn) error {
+			dials = append(dials, network+" "+address)
+			return nil
+		},
+	}
+
+	hook, err := New(Config{Protocol: "tcp", Address: ln.Addr().String(), Dialer: dialer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+
+	if err := hook.reconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"tcp4 " + ln.Addr().String(), "tcp4 " + ln.Addr().String()}
+	if !reflect.DeepEqual(dials, expected) {
+		t.Errorf("expected dialer to be used by New and reconnect as %v but got %v", expected, dials)
+	}
+}
+
+func TestNewWritesConnectHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b := make([]byte, 1024)
+		n, _ := conn.Read(b)
+		received <- b[:n]
+	}()
+
+	hook, err := New(Config{Protocol: "tcp", Address: ln.Addr().String(), ConnectHeader: []byte("build=1.2.3\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+
+	// The header is written by New before any message is fired.
+	select {
+	case b := <-received:
+		if string(b) != "build=1.2.3\n" {
+			t.Errorf("expected header to be written on dial but got '%s'", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected header to be written on dial")
+	}
+}
+
+func TestHookConfig(t *testing.T) {
+	cfg := Config{
+		Conn:                     ConnMock{buff: bytes.NewBufferString("")},
+		Dialer:                   &net.Dialer{},
+		AppName:                  "bob",
+		Fields:                   logrus.Fields{"env": "test"},
+		Prefix:                   "_",
+		Async:                    true,
+		AsyncBufferSize:          4,
+		WaitUntilBufferFrees:     true,
+		MaxBufferAge:             time.Minute,
+		DeliveryMode:             AtLeastOnce,
+		SpillDir:                 "/tmp/spill",
+		Timeout:                  2 * time.Second,
+		MaxSendRetries:           3,
+		RetryBudget:              5 * time.Second,
+		ReconnectBaseDelay:       time.Second,
+		ReconnectDelayMultiplier: 2,
+		MaxReconnectRetries:      5,
+		Backoff:                  ExponentialBackoff{BaseDelay: time.Millisecond},
+		IdleTimeout:              time.Hour,
+		Formatter:                &LogstashFormatter{Type: "custom"},
+		Framing:                  LengthPrefixFraming,
+		Compress:                 true,
+		CompressMinSize:          512,
+		TimeFormat:               time.RFC3339,
+		SendAttemptsKey:          "attempts",
+		ConnectHeader:            []byte("build=1.2.3\n"),
+	}
+	hook, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+
+	if got := hook.Config(); !reflect.DeepEqual(got, cfg) {
+		t.Errorf("expected config to be %+v but got %+v", cfg, got)
+	}
+
+	hook.WithField("region", "eu")
+	hook.Timeout = time.Second
+	got := hook.Config()
+	if got.Fields["region"] != "eu" || got.Timeout != time.Second {
+		t.Errorf("expected config to reflect current settings but got %+v", got)
+	}
+	got.Fields["user"] = "alice"
+	if _, ok := hook.Config().Fields["user"]; ok {
+		t.Error("expected config to not share fields with the hook")
+	}
+
+	lazy, err := New(Config{Protocol: "tcp", Address: "localhost:9999", LazyConnect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lazy.Close()
+	if got := lazy.Config(); got.Protocol != "tcp" || got.Address != "localhost:9999" || !got.LazyConnect || got.Conn != nil {
+		t.Errorf("expected lazy hook to report address of logstash but got %+v", got)
+	}
+}
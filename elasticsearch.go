@@ -0,0 +1,124 @@
+package logrustash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ElasticsearchBulkFormatter generates lines of Elasticsearch bulk API: index action followed by the document.
+type ElasticsearchBulkFormatter struct {
+	Index     string           // Index of documents.
+	Formatter logrus.Formatter // Formats documents. LogstashFormatter is used if it is nil.
+}
+
+// Format formats log message.
+func (f *ElasticsearchBulkFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return f.FormatWithPrefix(entry, "")
+}
+
+// FormatWithPrefix removes prefix from keys and formats log message.
+func (f *ElasticsearchBulkFormatter) FormatWithPrefix(entry *logrus.Entry, prefix string) ([]byte, error) {
+	formatter := f.Formatter
+	if formatter == nil {
+		formatter = &LogstashFormatter{}
+	}
+
+	var document []byte
+	var err error
+	if pf, ok := formatter.(prefixFormatter); ok {
+		document, err = pf.FormatWithPrefix(entry, prefix)
+	} else {
+		document, err = formatter.Format(entry)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	action, err := json.Marshal(map[string]interface{}{
+		"index": map[string]string{"_index": f.Index},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal bulk action to JSON, %v", err)
+	}
+
+	// Bulk API requires each document on a single line ending with newline.
+	document = bytes.TrimSuffix(document, []byte{'\n'})
+	if bytes.IndexByte(document, '\n') >= 0 {
+		return nil, fmt.Errorf("Document for bulk API must be a single line")
+	}
+
+	line := make([]byte, 0, len(action)+len(document)+2)
+	line = append(line, action...)
+	line = append(line, '\n')
+	line = append(line, document...)
+
+	return append(line, '\n'), nil
+}
+
+// NewElasticsearchHook creates a new hook which sends messages directly to Elasticsearch bulk API at url,
+// e.g. http://elasticsearch:9200, indexing them to index. Requests are retried like with NewHTTPHook.
+// Requests with rejected documents fail without retry, so they aren't indexed twice.
+func NewElasticsearchHook(url, index, appName string) (*Hook, error) {
+	hook, err := newHTTPHook(strings.TrimSuffix(url, "/")+"/_bulk", appName, checkBulkResponse)
+	if err != nil {
+		return nil, err
+	}
+	hook.Formatter = &ElasticsearchBulkFormatter{
+		Index:     index,
+		Formatter: &LogstashFormatter{Type: appName},
+	}
+
+	return hook, nil
+}
+
+// NewAsyncElasticsearchHook creates a new hook which sends messages directly to Elasticsearch bulk API at url.
+// Logs will be sent asynchronously.
+func NewAsyncElasticsearchHook(url, index, appName string) (*Hook, error) {
+	hook, err := NewElasticsearchHook(url, index, appName)
+	if err != nil {
+		return nil, err
+	}
+	hook.AsyncBufferSize = 8192
+	hook.makeAsync()
+
+	return hook, nil
+}
+
+// checkBulkResponse returns error if Elasticsearch rejected some of documents.
+func checkBulkResponse(body []byte) error {
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("Couldn't parse Elasticsearch bulk response: %v", err)
+	}
+	if !resp.Errors {
+		return nil
+	}
+
+	failed := 0
+	reason := ""
+	for _, item := range resp.Items {
+		for _, result := range item {
+			if result.Status >= 300 {
+				failed++
+				if reason == "" {
+					reason = result.Error.Type + ": " + result.Error.Reason
+				}
+			}
+		}
+	}
+
+	return fmt.Errorf("Elasticsearch rejected %d of %d documents, first reason: %s", failed, len(resp.Items), reason)
+}
@@ -0,0 +1,100 @@
+package logrustash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestElasticsearchBulkFormatter(t *testing.T) {
+	bf := ElasticsearchBulkFormatter{Index: "logs", Formatter: &LogstashFormatter{Type: "abc"}}
+
+	b, err := bf.FormatWithPrefix(&logrus.Entry{Message: "msg", Data: logrus.Fields{"_id": 1}}, "_")
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected action and document lines but got '%s'", b)
+	}
+	if string(lines[0]) != `{"index":{"_index":"logs"}}` {
+		t.Errorf("expected index action but got '%s'", lines[0])
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(lines[1], &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["message"] != "msg" || doc["type"] != "abc" || doc["id"] != float64(1) {
+		t.Errorf("expected formatted document but got '%s'", lines[1])
+	}
+}
+
+func TestElasticsearchHook(t *testing.T) {
+	var requests []time.Time
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, time.Now())
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(requests) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[{"index":{"status":201}}]}`))
+	}))
+	defer server.Close()
+
+	hook, err := NewElasticsearchHook(server.URL+"/", "logs", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.MaxSendRetries = 1
+	hook.ReconnectBaseDelay = 50 * time.Millisecond
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+		t.Fatalf("expected fire to succeed after retry but got: %s", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests but got %d", len(requests))
+	}
+	if delay := requests[1].Sub(requests[0]); delay < hook.ReconnectBaseDelay {
+		t.Errorf("expected request to be retried after %s but got %s", hook.ReconnectBaseDelay, delay)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	var lines []map[string]interface{}
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("expected bulk line to be JSON but got '%s'", scanner.Bytes())
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 || lines[0]["index"] == nil || lines[1]["message"] != "hello" || lines[1]["type"] != "bob" {
+		t.Errorf("expected action and document lines but got '%s'", body)
+	}
+}
+
+func TestCheckBulkResponse(t *testing.T) {
+	if err := checkBulkResponse([]byte(`{"errors":false,"items":[{"index":{"status":201}}]}`)); err != nil {
+		t.Errorf("expected successful response to be accepted but got: %s", err)
+	}
+
+	err := checkBulkResponse([]byte(`{"errors":true,"items":[{"index":{"status":201}},` +
+		`{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`))
+	if err == nil || err.Error() != "Elasticsearch rejected 1 of 2 documents, first reason: mapper_parsing_exception: failed to parse" {
+		t.Errorf("expected rejected documents to be reported but got: %v", err)
+	}
+}
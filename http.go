@@ -0,0 +1,206 @@
+package logrustash
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NewHTTPHook creates a new hook which POSTs messages to the http input plugin of Logstash at url.
+// Set HTTPHeader to send e.g. Authorization header. Responses with 5xx and 429 status are retried
+// up to MaxSendRetries times, Timeout limits each request. Requests rejected with 429 status are retried
+// after delay from Retry-After header or the reconnect delay, the wait is aborted when RetryBudget is exhausted.
+func NewHTTPHook(url, appName string) (*Hook, error) {
+	return newHTTPHook(url, appName, nil)
+}
+
+func newHTTPHook(url, appName string, checkResponse func(body []byte) error) (*Hook, error) {
+	if err := validateHTTPURL(url); err != nil {
+		return nil, err
+	}
+
+	hook := &Hook{
+		protocol:         "http",
+		address:          url,
+		appName:          appName,
+		alwaysSentFields: make(logrus.Fields),
+		created:          time.Now(),
+	}
+	hook.dialFunc = func(protocol, address string) (net.Conn, error) {
+		return &httpConn{hook: hook, url: address, checkResponse: checkResponse}, nil
+	}
+	hook.conn, _ = hook.dial()
+
+	return hook, nil
+}
+
+// NewAsyncHTTPHook creates a new hook which POSTs messages to the http input plugin of Logstash at url.
+// Logs will be sent asynchronously.
+func NewAsyncHTTPHook(url, appName string) (*Hook, error) {
+	hook, err := NewHTTPHook(url, appName)
+	if err != nil {
+		return nil, err
+	}
+	hook.AsyncBufferSize = 8192
+	hook.makeAsync()
+
+	return hook, nil
+}
+
+func validateHTTPURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("Invalid logstash URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Logstash URL %q must be absolute http or https URL", rawurl)
+	}
+
+	return nil
+}
+
+// httpConn sends each write as a POST request, so the hook sends messages over HTTP like over other connections.
+type httpConn struct {
+	hook          *Hook
+	url           string
+	deadline      time.Time
+	throttled     int                     // Number of requests in a row rejected with 429 status.
+	checkResponse func(body []byte) error // Checks body of successful response if it is set.
+}
+
+// httpTemporaryError is returned when the request may succeed if it is sent again.
+type httpTemporaryError struct {
+	err        error
+	retryAfter time.Duration // Delay before the request is retried, e.g. from Retry-After header.
+}
+
+func (e httpTemporaryError) Error() string { return e.err.Error() }
+func (httpTemporaryError) Timeout() bool   { return false }
+func (httpTemporaryError) Temporary() bool { return true }
+
+func (c *httpConn) Write(b []byte) (int, error) {
+	ctx := context.Background()
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	if c.hook.Framing == JSONArrayFraming {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if isGzip(b) {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range c.hook.HTTPHeader {
+		req.Header[k] = v
+	}
+
+	client := c.hook.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, httpTemporaryError{err: err}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// The hook waits before the request is retried to let the server catch up.
+		delay := c.retryAfter(resp)
+		c.throttled++
+
+		return 0, httpTemporaryError{err: fmt.Errorf("Logstash responded with %s", resp.Status), retryAfter: delay}
+	}
+	c.throttled = 0
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if c.checkResponse != nil {
+			if err == nil {
+				err = c.checkResponse(body)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return len(b), nil
+	case resp.StatusCode >= 500:
+		return 0, httpTemporaryError{err: fmt.Errorf("Logstash responded with %s", resp.Status)}
+	default:
+		return 0, fmt.Errorf("Logstash responded with %s", resp.Status)
+	}
+}
+
+// retryAfter returns delay from Retry-After header in seconds or the reconnect delay of the hook backoff
+// growing with each throttled request in a row.
+func (c *httpConn) retryAfter(resp *http.Response) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return c.hook.backoff().NextDelay(c.throttled)
+}
+
+// retryDelay returns how long to wait before the message is resent after err, e.g. after throttled request.
+func retryDelay(err error) time.Duration {
+	if e, ok := err.(httpTemporaryError); ok {
+		return e.retryAfter
+	}
+
+	return 0
+}
+
+func (c *httpConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *httpConn) Close() error {
+	return nil
+}
+
+func (c *httpConn) LocalAddr() net.Addr {
+	return httpAddr("")
+}
+
+func (c *httpConn) RemoteAddr() net.Addr {
+	return httpAddr(c.url)
+}
+
+func (c *httpConn) SetDeadline(t time.Time) error {
+	return c.SetWriteDeadline(t)
+}
+
+func (c *httpConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *httpConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+type httpAddr string
+
+func (a httpAddr) Network() string { return "http" }
+func (a httpAddr) String() string  { return string(a) }
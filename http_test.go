@@ -0,0 +1,219 @@
+package logrustash
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHTTPHook(t *testing.T) {
+	var requests int
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	hook, err := NewHTTPHook(server.URL, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.HTTPHeader = http.Header{"Authorization": {"Bearer secret"}}
+	hook.MaxSendRetries = 1
+	hook.Timeout = time.Second
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+		t.Fatalf("expected fire to succeed after retry but got: %s", err)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests but got %d", requests)
+	}
+
+	var res map[string]string
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "hello" || res["type"] != "bob" {
+		t.Errorf("expected formatted entry to be posted but got '%s'", body)
+	}
+
+	// Client errors aren't retried.
+	requests = 0
+	hook.HTTPHeader = nil
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err == nil {
+		t.Error("expected fire to return error")
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request but got %d", requests)
+	}
+}
+
+func TestHTTPHookThrottled(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if r.URL.Query().Get("throttle") != "" {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	hook, err := NewHTTPHook(server.URL, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.MaxSendRetries = 1
+	hook.ReconnectBaseDelay = 100 * time.Millisecond
+	hook.ReconnectDelayMultiplier = 1
+
+	// The hook isn't locked while it waits before retry.
+	blocked := make(chan time.Duration, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		start := time.Now()
+		hook.BytesSent()
+		blocked <- time.Since(start)
+	}()
+	start := time.Now()
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+		t.Fatalf("expected fire to succeed after retry but got: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected throttled request to be retried after delay but got %s", elapsed)
+	}
+	if d := <-blocked; d > 50*time.Millisecond {
+		t.Errorf("expected hook to not be locked during retry delay but reading it took %s", d)
+	}
+
+	// Retry-After isn't waited when no retry follows or it exceeds RetryBudget.
+	hook.conn = &httpConn{hook: hook, url: server.URL + "?throttle=1"}
+	for _, retries := range []int{0, 1} {
+		hook.MaxSendRetries = retries
+		hook.RetryBudget = 50 * time.Millisecond
+		start := time.Now()
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err == nil {
+			t.Error("expected fire to return error")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected fire with %d retries to not wait for Retry-After but it took %s", retries, elapsed)
+		}
+	}
+}
+
+func TestNewHTTPHookInvalidURL(t *testing.T) {
+	for _, rawurl := range []string{"logstash:8080", "tcp://logstash:8080", "http://", "http://%zz"} {
+		if _, err := NewHTTPHook(rawurl, "bob"); err == nil {
+			t.Errorf("expected %s to be rejected", rawurl)
+		}
+	}
+}
+
+func TestHTTPHookJSONArrayBatch(t *testing.T) {
+	var contentType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	hook, err := NewHTTPHook(server.URL, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Framing = JSONArrayFraming
+
+	hook.sendBatch([]*logrus.Entry{
+		{Message: "first", Data: logrus.Fields{}},
+		{Message: "second", Data: logrus.Fields{}},
+		{Message: "third", Data: logrus.Fields{}},
+	})
+
+	if contentType != "application/json" {
+		t.Errorf("expected content type to be '%s' but got '%s'", "application/json", contentType)
+	}
+	var res []map[string]string
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatalf("expected batch to be JSON array but got '%s'", body)
+	}
+	if len(res) != 3 || res[0]["message"] != "first" || res[2]["message"] != "third" {
+		t.Errorf("expected 3 messages in batch but got '%s'", body)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "single", Data: logrus.Fields{}}); err != nil {
+		t.Error(err)
+	}
+	if err := json.Unmarshal(body, &res); err != nil || len(res) != 1 || res[0]["message"] != "single" {
+		t.Errorf("expected single message to be sent as JSON array but got '%s'", body)
+	}
+}
+
+func TestHTTPHookCompressMinSize(t *testing.T) {
+	var encoding string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		reader := r.Body
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			reader = zr
+		}
+		body, _ = ioutil.ReadAll(reader)
+	}))
+	defer server.Close()
+
+	hook, err := NewHTTPHook(server.URL, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Compress = true
+	hook.CompressMinSize = 1024
+
+	for _, te := range []struct {
+		message  string
+		encoding string
+	}{
+		{"small", ""},
+		{strings.Repeat("large ", 500), "gzip"},
+	} {
+		if err := hook.Fire(&logrus.Entry{Message: te.message, Data: logrus.Fields{}}); err != nil {
+			t.Fatal(err)
+		}
+		if encoding != te.encoding {
+			t.Errorf("expected content encoding to be '%s' but got '%s'", te.encoding, encoding)
+		}
+
+		var res map[string]string
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res["message"] != te.message {
+			t.Errorf("expected message to be '%s' but got '%s'", te.message, res["message"])
+		}
+	}
+}
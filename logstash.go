@@ -1,12 +1,28 @@
 package logrustash
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
-	"math"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -18,21 +34,203 @@ type Hook struct {
 	sync.RWMutex
 	conn                     net.Conn
 	protocol                 string
-	address                  string
+	address                  string // Kept unresolved so every dial looks up the host again.
+	dialFunc                 func(protocol, address string) (net.Conn, error)
 	appName                  string
 	alwaysSentFields         logrus.Fields
+	fieldProviders           []func() (string, interface{})
+	contextExtractors        []func(context.Context) logrus.Fields
+	middlewares              []func(*logrus.Entry) (*logrus.Entry, error)
+	fieldLevels              map[string]logrus.Level // Hook fields which are sent only with entries at least as severe as the level.
 	hookOnlyPrefix           string
 	TimeFormat               string
-	fireChannel              chan *logrus.Entry
+	AppNameFromProcess       bool                       // Use process name as type if app name is empty, so messages aren't left untyped.
+	TypeRouter               func(*logrus.Entry) string // Returns type of the entry, e.g. by its stream field, overriding app name. Empty result keeps app name.
+	Formatter                logrus.Formatter           // Formats entries before sending. LogstashFormatter is used if it is nil. Use SetFormatter to replace it while sending.
+	Framing                  Framing                    // How messages are delimited. Newline by default.
+	DeadLetter               func(*logrus.Entry, error) // Receives entries which couldn't be formatted or are longer than MaxLineBytes.
+	MaxLineBytes             int                        // Messages longer than this, including framing, aren't sent: they are passed to DeadLetter with ErrLineTooLong. No limit if zero.
+	Compress                 bool                       // Gzip each HTTP request, e.g. a batch, with Content-Encoding header. Other connections require LengthPrefixFraming and get each message gzipped inside its frame, receiver must detect it by the magic number.
+	CompressMinSize          int                        // Requests and messages smaller than this many bytes are sent uncompressed, as gzip overhead exceeds savings.
+	HTTPHeader               http.Header                // Headers of requests sent by HTTP hook, e.g. Authorization.
+	HTTPClient               *http.Client               // Client of HTTP hook. Defaults to http.DefaultClient.
+	EnvelopeKey              string                     // Wraps formatted JSON document under this key, e.g. "log", with envelope fields at top level. Disabled if empty.
+	EnvelopeFields           logrus.Fields              // Top-level fields of the envelope, e.g. tenant_id.
+	EnvelopeProvider         func() logrus.Fields       // Called for each message to get top-level fields of the envelope. They override EnvelopeFields.
+	fireChannel              chan bufferedEntry
+	done                     chan struct{}  // Closed on shutdown to stop the async worker.
+	workerWG                 sync.WaitGroup // Tracks the async worker so shutdown can wait for it.
+	closeOnce                sync.Once
+	closed                   int32          // Set atomically on shutdown, the hook lock may be held by the worker blocked in write.
+	enqueueMu                sync.RWMutex   // Makes closed check and registration in enqueueWG atomic.
+	enqueueWG                sync.WaitGroup // Tracks goroutines putting entries to the async buffer, so the worker waits for them on shutdown.
+	shutdownFlushOnce        sync.Once
+	stopShutdownFlush        func()               // Uninstalls the listener installed by InstallShutdownFlush.
+	shards                   []chan bufferedEntry // Per worker buffers if the hook has several async workers.
+	shardKey                 func(*logrus.Entry) string
+	nextShard                int
 	AsyncBufferSize          int
 	WaitUntilBufferFrees     bool
+	OverflowPolicies         map[logrus.Level]OverflowPolicy // Overrides WaitUntilBufferFrees for particular levels.
+	DeliveryMode             DeliveryMode                    // Declares delivery semantics, see the constants for the options each mode overrides. BestEffort by default.
+	BatchDrain               bool                            // Async worker sends all buffered messages with a single write. Ignored with several async workers.
+	SpillDir                 string                          // Directory where messages which overflow async buffer are saved instead of being dropped. They are sent by the async worker on start and after reconnect. Disabled if empty, required by AtLeastOnce.
+	SpillMaxBytes            int64                           // Size limit of the spill file, messages are dropped above it. No limit if zero.
+	MaxBufferAge             time.Duration                   // Async worker drops entries which waited in the buffer longer than this, e.g. during a long outage. Disabled if zero.
+	IncludeBufferDepth       bool                            // Send the number of entries in async buffer when the entry was put there, e.g. to diagnose buffer pressure.
+	BufferDepthKey           string                          // Field for buffer depth. Defaults to "buffer_depth".
+	spillMu                  sync.Mutex
+	spillPending             bool
+	spillChecked             bool          // Whether the spill file left by the previous run was checked.
 	Timeout                  time.Duration // Timeout for sending message.
-	MaxSendRetries           int           // Declares how many times we will try to resend message.
-	ReconnectBaseDelay       time.Duration // First reconnect delay.
-	ReconnectDelayMultiplier float64       // Base multiplier for delay before reconnect.
-	MaxReconnectRetries      int           // Declares how many times we will try to reconnect.
+	RequireWriteDeadline     bool          // Fail sending if connection doesn't support write deadlines instead of sending without timeout.
+	deadlineUnsupported      bool
+	connPrepared             bool
+	IdleTimeout              time.Duration // Closes the connection when nothing was written for this long to free server slots, it is dialed again on the next send. Requires address of logstash.
+	idle                     bool          // Whether the connection was closed by IdleTimeout or isn't dialed yet with Config.LazyConnect.
+	idleTimer                *time.Timer
+	lastWrite                time.Time
+	KeepAlivePeriod          time.Duration                          // Enables TCP keepalive with this period. It is applied before the first write to a connection.
+	Dialer                   *net.Dialer                            // Dials logstash and reconnects instead of goautosocket, e.g. with FallbackDelay racing IPv6 and IPv4 on dual-stack hosts. Its connections don't redial on write errors, the hook reconnects as configured instead. Constructors dial immediately, so it applies to the first connection only if it is passed in Config to New.
+	WriteBufferSize          int                                    // Sets socket send buffer size (SO_SNDBUF) before the first write to a connection. System default is used if zero.
+	ConnectHeader            []byte                                 // Written as is to each new connection before the first message, e.g. a banner with build info. Reconnect writes it right after dial.
+	ValidateConn             func(net.Conn) error                   // Checks connection dialed by reconnect, e.g. with a probe write. Reconnect is retried if it fails.
+	OnWrite                  func(bytes int, latency time.Duration) // Called after each write to the connection, e.g. to feed a latency histogram.
+	OnSent                   func(entry *logrus.Entry, bytes int)   // Called after each message is sent with its size.
+	bytesSent                uint64
+	lastSendLatency          time.Duration
+	MaxSendRetries           int                    // Declares how many times we will try to resend message.
+	RetryBudget              time.Duration          // Limits total time of resending and reconnecting for a single send regardless of attempts left. No limit if zero.
+	SendAttemptsKey          string                 // Adds entry field with the number of attempts it took to send the entry under this key, unless the entry has it. Only entries sent one by one have it, batched, spilled and raw messages don't. Disabled if empty.
+	ReconnectBaseDelay       time.Duration          // First reconnect delay.
+	ReconnectDelayMultiplier float64                // Base multiplier for delay before reconnect.
+	MaxReconnectRetries      int                    // Declares how many times we will try to reconnect.
+	ReconnectAfterFailures   int                    // Forces reconnect after this many consecutive failed sends, e.g. if connection fails with errors other than net errors. Disabled if zero.
+	ClassifyError            func(error) ErrorClass // Decides whether send error is retried, reconnected or fatal. DefaultClassifyError is used if it is nil. Ignored if Backoff is set.
+	consecutiveFailures      int
+	AsyncReconnect           bool          // Async hook reconnects in background dropping messages meanwhile instead of stalling the buffer.
+	HealthCheckInterval      time.Duration // Interval of background connection probes started by StartHealthCheck.
+	backgroundMu             sync.Mutex    // Guards stop channels of background goroutines.
+	healthCheckStop          chan struct{}
+	SummaryInterval          time.Duration // Interval of summary entries started by StartSummary.
+	summaryStop              chan struct{}
+	summaryTicker            func(d time.Duration) (<-chan time.Time, func()) // Replaces time.NewTicker in tests.
+	levelCountsMu            sync.Mutex
+	levelCounts              map[logrus.Level]int // Entries fired since the last summary, nil if summary isn't started.
+	reconnecting             bool
+	reconnectBackground      bool                       // Reconnect in progress sheds messages instead of making them wait.
+	reconnectDone            chan struct{}              // Closed when reconnect in progress finishes.
+	Backoff                  BackoffStrategy            // Overrides the resend and reconnect options above if it is set.
+	CorrelationIDFunc        func() string              // Called on Fire to add correlation ID to the entry. Disabled if nil.
+	CorrelationIDKey         string                     // Field for correlation ID. Defaults to "correlation_id".
+	DryRun                   bool                       // Write formatted entries to DryRunWriter instead of sending them to logstash.
+	DryRunWriter             io.Writer                  // Defaults to os.Stdout.
+	IncludeProcess           bool                       // Send process ID and name with each message.
+	ProcessPIDKey            string                     // Field for process ID. Defaults to "process.pid".
+	ProcessNameKey           string                     // Field for process name. Defaults to "process.name".
+	IncludeHostname          bool                       // Send host name with each message.
+	HostnameKey              string                     // Field for host name. Defaults to "hostname".
+	HostnameFunc             func() string              // Returns host name, e.g. Kubernetes pod name. Defaults to os.Hostname.
+	IncludeLocalAddr         bool                       // Send local address of the connection with each message, e.g. to find out egress path.
+	LocalAddrKey             string                     // Field for local address. Defaults to "net.local_addr".
+	StackTraceLevels         []logrus.Level             // Send stack trace of the logging goroutine as a single field with entries of these levels, e.g. errors.
+	StackTraceKey            string                     // Field for stack trace. Defaults to "stack_trace".
+	IncludeUptime            bool                       // Send milliseconds since the hook was created with each message.
+	UptimeKey                string                     // Field for uptime. Defaults to "uptime_ms".
+	SchemaVersion            string                     // Sent with each message, e.g. "2", so consumers can handle changes of field conventions. Disabled if empty.
+	SchemaVersionKey         string                     // Field for schema version. Defaults to "log_schema_version".
+	PartitionKeyFunc         func(*logrus.Entry) string // Returns partition key of the entry, e.g. user ID, so downstream systems route related entries consistently. No field is sent for empty key.
+	PartitionKeyKey          string                     // Field for partition key. Defaults to "partition_key".
+	IncludeEventID           bool                       // Send ID of each entry, so logstash can drop duplicates of entries resent after reconnect or replayed from SpillDir.
+	EventIDKey               string                     // Field for event ID. Defaults to "event_id".
+	EventIDFunc              func(*logrus.Entry) string // Returns ID of the entry, e.g. from request ID field. Defaults to hash of the entry and its sequence number.
+	eventSeq                 uint64                     // Sequence number of the last entry with event ID, changed atomically.
+	created                  time.Time
 }
 
+const (
+	defaultCorrelationIDKey = "correlation_id"
+	defaultProcessPIDKey    = "process.pid"
+	defaultProcessNameKey   = "process.name"
+	defaultEnvironmentKey   = "env"
+	defaultHostnameKey      = "hostname"
+	defaultUptimeKey        = "uptime_ms"
+	defaultSchemaVersionKey = "log_schema_version"
+	defaultBufferDepthKey   = "buffer_depth"
+	defaultPartitionKeyKey  = "partition_key"
+	defaultEventIDKey       = "event_id"
+	defaultLocalAddrKey     = "net.local_addr"
+	defaultStackTraceKey    = "stack_trace"
+	defaultEnvironmentVar   = "APP_ENV"
+)
+
+// defaultDeliveryRetries is the number of resends and reconnects of AtLeastOnce delivery mode if they aren't set.
+const defaultDeliveryRetries = 3
+
+var (
+	processPID   = os.Getpid()
+	processName  = filepath.Base(os.Args[0])
+	processStart = time.Now()
+	hostname, _  = os.Hostname()
+)
+
+// ErrReconnecting is returned for messages dropped while the hook reconnects in background,
+// see AsyncReconnect and AtMostOnce. Other reconnects make messages wait.
+var ErrReconnecting = errors.New("Message dropped because hook is reconnecting to logstash")
+
+// ErrHookClosed is returned for messages fired after the hook was closed.
+var ErrHookClosed = errors.New("Message dropped because hook is closed")
+
+// ErrLineTooLong is returned for messages which aren't sent because they are longer than MaxLineBytes.
+var ErrLineTooLong = errors.New("Message dropped because it is longer than MaxLineBytes")
+
+// ErrSpillDirRequired is returned for messages fired with AtLeastOnce delivery mode if SpillDir isn't set.
+var ErrSpillDirRequired = errors.New("Message dropped because AtLeastOnce delivery mode requires SpillDir")
+
+// errCompressFraming is returned for messages of compressed streams which aren't length prefixed.
+var errCompressFraming = errors.New("Compressed messages must be sent with LengthPrefixFraming")
+
+// errSpilled is returned by performSend for messages which couldn't be sent and were saved to SpillDir.
+var errSpilled = errors.New("Message saved to spill file because it couldn't be sent")
+
+// Framing declares how messages are delimited in the stream.
+type Framing int
+
+// Framings.
+const (
+	NewlineFraming      Framing = iota // Messages are followed by newline as formatters make them.
+	LengthPrefixFraming                // Messages are prefixed by 4-byte big-endian length instead of newline.
+	JSONArrayFraming                   // Messages of each write are sent as JSON array, e.g. for HTTP input with json codec.
+)
+
+// OverflowPolicy declares what happens with a log message when async buffer is full.
+type OverflowPolicy int
+
+// Overflow policies.
+const (
+	OverflowDefault OverflowPolicy = iota // Depends on WaitUntilBufferFrees.
+	OverflowDrop                          // Drop message.
+	OverflowBlock                         // Wait until buffer frees.
+)
+
+// DeliveryMode declares delivery semantics of messages in sync and async modes.
+type DeliveryMode int
+
+// Delivery modes.
+const (
+	// BestEffort lets the retry, reconnect, spill and buffer options of the hook decide.
+	BestEffort DeliveryMode = iota
+	// AtMostOnce never writes a message twice: MaxSendRetries is ignored and a message which failed is dropped.
+	// Broken connection is replaced in background even if MaxReconnectRetries is zero and messages are dropped
+	// meanwhile. Async buffer drops messages when it is full.
+	AtMostOnce
+	// AtLeastOnce resends messages and reconnects as the backoff strategy decides, with 3 resends and 3 reconnects
+	// if MaxSendRetries and MaxReconnectRetries are zero. Messages which still couldn't be sent are saved to SpillDir
+	// and resent after the next successful send. SpillDir is required, ErrSpillDirRequired is returned without it.
+	// Async buffer waits when it is full. Logstash may receive duplicates.
+	AtLeastOnce
+)
+
 // NewHook creates a new hook to a Logstash instance, which listens on
 // `protocol`://`address`.
 func NewHook(protocol, address, appName string) (*Hook, error) {
@@ -73,16 +271,21 @@ func NewAsyncHookWithFields(protocol, address, appName string, alwaysSentFields
 // NewHookWithFieldsAndPrefix creates a new hook to a Logstash instance, which listens on
 // `protocol`://`address`. alwaysSentFields will be sent with every log entry. prefix is used to select fields to filter.
 func NewHookWithFieldsAndPrefix(protocol, address, appName string, alwaysSentFields logrus.Fields, prefix string) (*Hook, error) {
-	conn, err := gas.Dial(protocol, address)
+	hook := &Hook{
+		protocol:         protocol,
+		address:          address,
+		appName:          appName,
+		alwaysSentFields: alwaysSentFields,
+		hookOnlyPrefix:   prefix,
+		created:          time.Now(),
+	}
+	conn, err := hook.dial()
 	if err != nil {
 		return nil, err
 	}
+	hook.setConn(conn)
 
-	hook, err := NewHookWithFieldsAndConnAndPrefix(conn, appName, alwaysSentFields, prefix)
-	hook.protocol = protocol
-	hook.address = address
-
-	return hook, err
+	return hook, nil
 }
 
 // NewAsyncHookWithFieldsAndPrefix creates a new hook to a Logstash instance, which listens on
@@ -112,13 +315,13 @@ func NewAsyncHookWithFieldsAndConn(conn net.Conn, appName string, alwaysSentFiel
 
 //NewHookWithFieldsAndConnAndPrefix creates a new hook to a Logstash instance using the suppolied connection and prefix.
 func NewHookWithFieldsAndConnAndPrefix(conn net.Conn, appName string, alwaysSentFields logrus.Fields, prefix string) (*Hook, error) {
-	return &Hook{conn: conn, appName: appName, alwaysSentFields: alwaysSentFields, hookOnlyPrefix: prefix}, nil
+	return &Hook{conn: conn, appName: appName, alwaysSentFields: alwaysSentFields, hookOnlyPrefix: prefix, created: time.Now()}, nil
 }
 
 // NewAsyncHookWithFieldsAndConnAndPrefix creates a new hook to a Logstash instance using the suppolied connection and prefix.
 // Logs will be sent asynchronously.
 func NewAsyncHookWithFieldsAndConnAndPrefix(conn net.Conn, appName string, alwaysSentFields logrus.Fields, prefix string) (*Hook, error) {
-	hook := &Hook{conn: conn, appName: appName, alwaysSentFields: alwaysSentFields, hookOnlyPrefix: prefix}
+	hook := &Hook{conn: conn, appName: appName, alwaysSentFields: alwaysSentFields, hookOnlyPrefix: prefix, created: time.Now()}
 	hook.makeAsync()
 
 	return hook, nil
@@ -137,7 +340,7 @@ func NewAsyncFilterHook() *Hook {
 
 // NewFilterHookWithPrefix make a new hook which does not forward to logstash, but simply enforces the specified prefix.
 func NewFilterHookWithPrefix(prefix string) *Hook {
-	return &Hook{conn: nil, appName: "", alwaysSentFields: make(logrus.Fields), hookOnlyPrefix: prefix}
+	return &Hook{conn: nil, appName: "", alwaysSentFields: make(logrus.Fields), hookOnlyPrefix: prefix, created: time.Now()}
 }
 
 // NewAsyncFilterHookWithPrefix make a new hook which does not forward to logstash, but simply enforces the specified prefix.
@@ -149,16 +352,307 @@ func NewAsyncFilterHookWithPrefix(prefix string) *Hook {
 	return hook
 }
 
+// EnableForwarding dials `protocol`://`address` and makes the hook forward subsequent messages to it,
+// e.g. turning a filter hook into a logstash one. The address is also used for reconnect.
+func (h *Hook) EnableForwarding(protocol, address string) error {
+	h.Lock()
+	h.protocol = protocol
+	h.address = address
+	h.Unlock()
+
+	conn, err := h.dial()
+	if err != nil {
+		return err
+	}
+
+	h.setConn(conn)
+
+	return nil
+}
+
+// bufferedEntry is an entry in the async buffer with the time it was put there.
+type bufferedEntry struct {
+	entry    *logrus.Entry
+	enqueued time.Time
+}
+
 func (h *Hook) makeAsync() {
-	h.fireChannel = make(chan *logrus.Entry, h.AsyncBufferSize)
+	h.fireChannel = make(chan bufferedEntry, h.AsyncBufferSize)
+	h.done = make(chan struct{})
 
-	go func() {
-		for entry := range h.fireChannel {
-			if err := h.sendMessage(entry); err != nil {
-				fmt.Println("Error during sending message to logstash:", err)
+	h.workerWG.Add(1)
+	go h.worker()
+}
+
+// worker sends entries from the buffer until shutdown.
+// On shutdown it sends entries which are already buffered and exits.
+// With several async workers it dispatches entries to them instead of sending.
+func (h *Hook) worker() {
+	defer h.workerWG.Done()
+	defer h.closeShards()
+
+	h.replaySpill()
+
+	for {
+		select {
+		case buffered := <-h.fireChannel:
+			h.dispatch(buffered)
+		case <-h.done:
+			// Entries may still be put to the buffer by Fire called concurrently with Close.
+			enqueued := make(chan struct{})
+			go func() {
+				h.enqueueWG.Wait()
+				close(enqueued)
+			}()
+
+			for {
+				select {
+				case buffered := <-h.fireChannel:
+					h.dispatch(buffered)
+				case <-enqueued:
+					for {
+						select {
+						case buffered := <-h.fireChannel:
+							h.dispatch(buffered)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func (h *Hook) dispatch(buffered bufferedEntry) {
+	h.replaySpill()
+
+	h.Lock()
+	if h.shards == nil {
+		h.Unlock()
+		if h.BatchDrain {
+			if entries := h.drain(buffered); len(entries) > 0 {
+				h.sendBatch(entries)
+			}
+		} else if !h.isStale(buffered) {
+			h.processEntry(buffered.entry)
+		}
+
+		return
+	}
+
+	var shard int
+	if h.shardKey != nil {
+		hash := fnv.New32a()
+		hash.Write([]byte(h.shardKey(buffered.entry)))
+		shard = int(hash.Sum32() % uint32(len(h.shards)))
+	} else {
+		shard = h.nextShard
+		h.nextShard = (h.nextShard + 1) % len(h.shards)
+	}
+	ch := h.shards[shard]
+	h.Unlock()
+
+	ch <- buffered
+}
+
+// drain returns the entry with entries which are already buffered, skipping stale ones.
+func (h *Hook) drain(buffered bufferedEntry) []*logrus.Entry {
+	var entries []*logrus.Entry
+	if !h.isStale(buffered) {
+		entries = append(entries, buffered.entry)
+	}
+	for i := 0; i < cap(h.fireChannel); i++ {
+		select {
+		case buffered := <-h.fireChannel:
+			if !h.isStale(buffered) {
+				entries = append(entries, buffered.entry)
 			}
+		default:
+			return entries
+		}
+	}
+
+	return entries
+}
+
+// isStale reports whether the entry waited in the buffer longer than MaxBufferAge.
+func (h *Hook) isStale(buffered bufferedEntry) bool {
+	return h.MaxBufferAge > 0 && time.Since(buffered.enqueued) > h.MaxBufferAge
+}
+
+func (h *Hook) closeShards() {
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, ch := range h.shards {
+		close(ch)
+	}
+}
+
+func (h *Hook) processEntry(entry *logrus.Entry) {
+	if err := h.sendMessage(context.Background(), entry); err != nil {
+		fmt.Println("Error during sending message to logstash:", err)
+	}
+}
+
+// SetAsyncWorkers makes async hook send messages with several workers.
+// Entries with the same shardKey are sent by the same worker in order of submission.
+// If shardKey is nil entries are spread between workers and their order isn't preserved.
+// It should be called once before the hook is used. It does nothing for sync hook.
+func (h *Hook) SetAsyncWorkers(workers int, shardKey func(*logrus.Entry) string) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.fireChannel == nil || h.shards != nil || workers < 2 {
+		return
+	}
+
+	h.shardKey = shardKey
+	h.shards = make([]chan bufferedEntry, workers)
+	for i := range h.shards {
+		h.shards[i] = make(chan bufferedEntry, cap(h.fireChannel)/workers)
+
+		h.workerWG.Add(1)
+		go func(ch chan bufferedEntry) {
+			defer h.workerWG.Done()
+
+			for buffered := range ch {
+				if !h.isStale(buffered) {
+					h.processEntry(buffered.entry)
+				}
+			}
+		}(h.shards[i])
+	}
+}
+
+// Close sends buffered entries, stops the async worker and closes the connection.
+func (h *Hook) Close() error {
+	return h.Shutdown(context.Background())
+}
+
+// Shutdown works like Close but stops waiting for the async worker when ctx is done.
+// In this case ctx error is returned and the connection is closed as soon as the worker exits.
+// Only the first call does the job, subsequent calls return nil.
+func (h *Hook) Shutdown(ctx context.Context) error {
+	var err error
+	h.closeOnce.Do(func() {
+		err = h.shutdown(ctx)
+	})
+
+	return err
+}
+
+func (h *Hook) shutdown(ctx context.Context) error {
+	h.enqueueMu.Lock()
+	atomic.StoreInt32(&h.closed, 1)
+	h.enqueueMu.Unlock()
+	h.stopBackground()
+
+	if h.done == nil {
+		return h.closeConn()
+	}
+
+	close(h.done)
+
+	stopped := make(chan struct{})
+	go func() {
+		h.workerWG.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return h.closeConn()
+	case <-ctx.Done():
+		go func() {
+			<-stopped
+			h.closeConn()
+		}()
+
+		return ctx.Err()
+	}
+}
+
+// InstallShutdownFlush makes the hook send buffered entries and close when the process gets SIGINT or SIGTERM,
+// waiting up to timeout. The hook doesn't raise the signal again or exit, so the application must exit itself,
+// e.g. from its own handler of the same signals. After the flush the listener stops, so the next signal has
+// the default effect unless the application handles it. The returned stop uninstalls the listener
+// and waits for a flush in progress. Only the first call has effect, later calls return the same stop.
+func (h *Hook) InstallShutdownFlush(timeout time.Duration) (stop func()) {
+	h.shutdownFlushOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+		h.stopShutdownFlush = h.listenShutdownFlush(signals, timeout, func() {
+			signal.Stop(signals)
+		})
+	})
+
+	return h.stopShutdownFlush
+}
+
+// listenShutdownFlush flushes the hook on the first signal received from signals and calls release when it stops
+// listening. The returned func stops listening and waits until the listener ends.
+func (h *Hook) listenShutdownFlush(signals <-chan os.Signal, timeout time.Duration, release func()) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer release()
+
+		select {
+		case <-signals:
+			h.flushOnSignal(timeout)
+		case <-stop:
 		}
 	}()
+
+	var stopOnce sync.Once
+	return func() {
+		stopOnce.Do(func() { close(stop) })
+		<-stopped
+	}
+}
+
+func (h *Hook) flushOnSignal(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := h.Shutdown(ctx); err != nil {
+		fmt.Println("Couldn't send buffered messages to logstash before exit:", err)
+	}
+}
+
+// dropConn closes the connection after a partial write, so the next message isn't appended to the fragment:
+// logstash drops it when the connection is closed. Hooks which know address of logstash dial it again
+// before the next write if reconnect doesn't replace the connection earlier.
+func (h *Hook) dropConn() {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.conn == nil || h.idle {
+		return
+	}
+
+	h.conn.Close()
+	if h.protocol != "" && h.address != "" {
+		h.idle = true
+	}
+}
+
+func (h *Hook) closeConn() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.idleTimer != nil {
+		h.idleTimer.Stop()
+	}
+	if h.conn == nil || h.idle {
+		return nil
+	}
+
+	return h.conn.Close()
 }
 
 func (h *Hook) filterHookOnly(entry *logrus.Entry) {
@@ -179,27 +673,241 @@ func (h *Hook) WithPrefix(prefix string) {
 
 //WithField add field with value that will be sent with each message
 func (h *Hook) WithField(key string, value interface{}) {
+	h.Lock()
+	defer h.Unlock()
+
 	h.alwaysSentFields[key] = value
 }
 
 // WithFields add fields with values that will be sent with each message
 func (h *Hook) WithFields(fields logrus.Fields) {
+	h.Lock()
+	defer h.Unlock()
+
 	// Add all the new fields to the 'alwaysSentFields', possibly overwriting existing fields
 	for key, value := range fields {
 		h.alwaysSentFields[key] = value
 	}
 }
 
+// WithEnvironment adds field with deployment environment read from envVar that will be sent with each message.
+// fallback is used if envVar isn't set. key and envVar default to "env" and "APP_ENV".
+func (h *Hook) WithEnvironment(key, envVar, fallback string) {
+	if key == "" {
+		key = defaultEnvironmentKey
+	}
+	if envVar == "" {
+		envVar = defaultEnvironmentVar
+	}
+
+	value, ok := os.LookupEnv(envVar)
+	if !ok {
+		value = fallback
+	}
+
+	h.WithField(key, value)
+}
+
+// WithExpandedFields adds fields with dotted keys expanded into nested objects, e.g. "a.b.c" into {"a":{"b":{"c":...}}},
+// for ECS-style indices. They are merged with nested objects added before. A key is sent as is
+// if its part is already used by a value which isn't an object.
+func (h *Hook) WithExpandedFields(fields map[string]interface{}) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h.Lock()
+	defer h.Unlock()
+
+	// Nested objects may be referenced by entries which are being sent, so they are copied before changing.
+	copied := make(map[string]bool)
+	for _, key := range keys {
+		parts := strings.Split(key, ".")
+		top, ok := h.alwaysSentFields[parts[0]].(map[string]interface{})
+		if len(parts) == 1 || (!ok && h.alwaysSentFields[parts[0]] != nil) {
+			h.alwaysSentFields[key] = fields[key]
+			continue
+		}
+		if !copied[parts[0]] {
+			top = copyObject(top)
+			copied[parts[0]] = true
+		}
+
+		if setNested(top, parts[1:], fields[key]) {
+			h.alwaysSentFields[parts[0]] = top
+		} else {
+			h.alwaysSentFields[key] = fields[key]
+		}
+	}
+}
+
+// setNested sets value in object by path creating nested objects. It returns false if the path is used by a value.
+func setNested(object map[string]interface{}, path []string, value interface{}) bool {
+	for _, part := range path[:len(path)-1] {
+		next, ok := object[part].(map[string]interface{})
+		if !ok {
+			if object[part] != nil {
+				return false
+			}
+			next = make(map[string]interface{})
+			object[part] = next
+		}
+		object = next
+	}
+
+	if _, ok := object[path[len(path)-1]].(map[string]interface{}); ok {
+		return false
+	}
+	object[path[len(path)-1]] = value
+
+	return true
+}
+
+// copyObject returns deep copy of nested objects.
+func copyObject(object map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(object))
+	for k, v := range object {
+		if nested, ok := v.(map[string]interface{}); ok {
+			v = copyObject(nested)
+		}
+		copied[k] = v
+	}
+
+	return copied
+}
+
+// RemoveField removes field which was sent with each message
+func (h *Hook) RemoveField(key string) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.alwaysSentFields, key)
+}
+
+// ReplaceFields replaces all fields which are sent with each message at once
+func (h *Hook) ReplaceFields(fields logrus.Fields) {
+	alwaysSentFields := make(logrus.Fields, len(fields))
+	for key, value := range fields {
+		alwaysSentFields[key] = value
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.alwaysSentFields = alwaysSentFields
+}
+
+// AddFieldProvider adds function called on each message to get field which value changes over time,
+// e.g. leader election state. Provided fields take precedence over the fields added with WithField.
+func (h *Hook) AddFieldProvider(provider func() (string, interface{})) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.fieldProviders = append(h.fieldProviders, provider)
+}
+
+// RegisterContextExtractor adds function called on each message with context of the entry (see logrus WithContext)
+// to get fields from it, e.g. trace ID or tenant. Fields of all extractors are merged, the ones registered earlier
+// take precedence. Extracted fields take precedence over provided fields and the fields added with WithField.
+func (h *Hook) RegisterContextExtractor(extractor func(context.Context) logrus.Fields) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.contextExtractors = append(h.contextExtractors, extractor)
+}
+
+// SetFormatter replaces Formatter while messages are being sent, e.g. to switch field schema without restart.
+// Entries which are being formatted keep the previous formatter. Nil formatter restores LogstashFormatter.
+func (h *Hook) SetFormatter(formatter logrus.Formatter) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.Formatter = formatter
+}
+
+// Use adds middleware which transforms entries before formatting, e.g. redacts them. Middlewares are applied
+// in order of adding. A middleware may return another entry, nil entry to drop it silently or error
+// to pass the entry to DeadLetter.
+func (h *Hook) Use(middleware func(*logrus.Entry) (*logrus.Entry, error)) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.middlewares = append(h.middlewares, middleware)
+}
+
+// SetFieldLevel makes the hook field or provided field with key sent only with entries at level or more severe,
+// e.g. verbose request context only with errors.
+func (h *Hook) SetFieldLevel(key string, level logrus.Level) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.fieldLevels == nil {
+		h.fieldLevels = make(map[string]logrus.Level)
+	}
+	h.fieldLevels[key] = level
+}
+
+// isFieldGated reports whether the hook field with key isn't sent with entry of the level.
+// It must be called with the hook locked.
+func (h *Hook) isFieldGated(key string, level logrus.Level) bool {
+	minLevel, ok := h.fieldLevels[key]
+	return ok && level > minLevel
+}
+
 // Fire send message to logstash.
 // In async mode log message will be dropped if message buffer is full.
 // If you want wait until message buffer frees – set WaitUntilBufferFrees to true.
+// OverflowPolicies overrides this behaviour for particular levels.
+// After the hook is closed messages are dropped and ErrHookClosed is returned.
 func (h *Hook) Fire(entry *logrus.Entry) error {
+	return h.FireCtx(context.Background(), entry)
+}
+
+// FireCtx sends message to logstash like Fire. In sync mode reconnect during an outage is aborted
+// when ctx is done and its error is returned, so the caller isn't blocked for the whole backoff.
+// In async mode ctx is ignored because entry is sent by the worker.
+func (h *Hook) FireCtx(ctx context.Context, entry *logrus.Entry) error {
+	if h.isClosed() {
+		return ErrHookClosed
+	}
+	if h.DeliveryMode == AtLeastOnce && h.SpillDir == "" {
+		return ErrSpillDirRequired
+	}
+
+	h.countLevel(entry.Level)
+
+	return h.fire(ctx, entry)
+}
+
+func (h *Hook) fire(ctx context.Context, entry *logrus.Entry) error {
+	h.initEntry(entry)
+
 	if h.fireChannel != nil { // Async mode.
+		h.addBufferDepth(entry)
+
+		if !h.startEnqueue() {
+			return ErrHookClosed
+		}
+		defer h.enqueueWG.Done()
+
 		select {
-		case h.fireChannel <- entry:
+		case h.fireChannel <- bufferedEntry{entry, time.Now()}:
 		default:
-			if h.WaitUntilBufferFrees {
-				h.fireChannel <- entry // Blocks the goroutine because buffer is full.
+			if h.isNeedToWaitForBuffer(entry.Level) {
+				// Blocks the goroutine because buffer is full.
+				select {
+				case h.fireChannel <- bufferedEntry{entry, time.Now()}:
+				case <-h.done:
+					return ErrHookClosed
+				}
+
+				return nil
+			}
+
+			if h.SpillDir != "" && h.DeliveryMode != AtMostOnce {
+				h.spill(entry)
 
 				return nil
 			}
@@ -210,124 +918,1362 @@ func (h *Hook) Fire(entry *logrus.Entry) error {
 		return nil
 	}
 
-	return h.sendMessage(entry)
+	return h.sendMessage(ctx, entry)
 }
 
-func (h *Hook) sendMessage(entry *logrus.Entry) error {
-	// Make sure we always clear the hook only fields from the entry
-	defer h.filterHookOnly(entry)
-
-	// Add in the alwaysSentFields. We don't override fields that are already set.
-	for k, v := range h.alwaysSentFields {
-		if _, inMap := entry.Data[k]; !inMap {
-			entry.Data[k] = v
-		}
+// TryFire puts entry to the async buffer without waiting for free space regardless of WaitUntilBufferFrees,
+// OverflowPolicies and SpillDir. It returns false if the buffer is full, the hook is closed or AtLeastOnce is set without SpillDir, e.g. to log the entry elsewhere.
+// In sync mode the entry is sent and false is returned if sending failed.
+func (h *Hook) TryFire(entry *logrus.Entry) bool {
+	if h.isClosed() || (h.DeliveryMode == AtLeastOnce && h.SpillDir == "") {
+		return false
 	}
 
-	// For a filteringHook, stop here
-	h.RLock()
-	if h.conn == nil {
-		h.RUnlock()
+	h.initEntry(entry)
 
-		return nil
+	if h.fireChannel == nil {
+		return h.sendMessage(context.Background(), entry) == nil
 	}
-	h.RUnlock()
 
-	formatter := LogstashFormatter{Type: h.appName}
-	if h.TimeFormat != "" {
-		formatter.TimestampFormat = h.TimeFormat
-	}
+	h.addBufferDepth(entry)
 
-	dataBytes, err := formatter.FormatWithPrefix(entry, h.hookOnlyPrefix)
-	if err != nil {
-		return err
+	if !h.startEnqueue() {
+		return false
 	}
+	defer h.enqueueWG.Done()
 
-	return h.performSend(dataBytes, 0)
+	select {
+	case h.fireChannel <- bufferedEntry{entry, time.Now()}:
+		return true
+	default:
+		return false
+	}
 }
 
-// performSend tries to send data recursively.
-// sendRetries is the actual number of attempts to resend message.
-func (h *Hook) performSend(data []byte, sendRetries int) error {
-	if h.Timeout > 0 {
-		h.Lock()
-		h.conn.SetWriteDeadline(time.Now().Add(h.Timeout))
-		h.Unlock()
+// startEnqueue registers the goroutine putting entry to the async buffer, so the worker doesn't exit
+// on shutdown before the entry is put. It returns false if the hook is closed.
+func (h *Hook) startEnqueue() bool {
+	h.enqueueMu.RLock()
+	defer h.enqueueMu.RUnlock()
+
+	if h.isClosed() {
+		return false
 	}
+	h.enqueueWG.Add(1)
 
-	h.Lock()
-	_, err := h.conn.Write(data)
-	h.Unlock()
+	return true
+}
 
-	if err != nil {
-		file := fmt.Sprintf("/tmp/logrustash-%d.tmp", time.Now().UnixNano())
-		ioutil.WriteFile(file, data, 0644)
-		fmt.Printf("Wrote message content to %s\n", file)
-		return h.processSendError(err, data, sendRetries)
+func (h *Hook) initEntry(entry *logrus.Entry) {
+	// Entries created manually may have no fields map.
+	if entry.Data == nil {
+		entry.Data = make(logrus.Fields)
 	}
 
-	return nil
-}
+	h.addCorrelationID(entry)
 
-func (h *Hook) processSendError(err error, data []byte, sendRetries int) error {
-	netErr, ok := err.(net.Error)
-	if !ok {
-		return err
+	// ID is added once on fire, so all sends of the entry carry the same one.
+	if h.IncludeEventID {
+		h.addEventID(entry)
 	}
 
-	if h.isNeedToResendMessage(netErr, sendRetries) {
-		return h.performSend(data, sendRetries+1)
+	if h.IncludeUptime {
+		addMissingField(entry, h.UptimeKey, defaultUptimeKey, h.uptime().Nanoseconds()/int64(time.Millisecond))
 	}
 
-	if !netErr.Temporary() && h.MaxReconnectRetries > 0 {
-		if err := h.reconnect(0); err != nil {
-			return fmt.Errorf("Couldn't reconnect to logstash: %s. The reason of reconnect: %s", err, netErr)
+	for _, level := range h.StackTraceLevels {
+		if level == entry.Level {
+			addMissingField(entry, h.StackTraceKey, defaultStackTraceKey, stackTrace())
+			break
 		}
-
-		return h.performSend(data, 0)
 	}
-
-	return err
 }
 
-// TODO Check reconnect for NOT ASYNC mode.
-// The hook will reconnect to Logstash several times with increasing sleep duration between each reconnect attempt.
-// Sleep duration calculated as product of ReconnectBaseDelay by ReconnectDelayMultiplier to the power of reconnectRetries.
-// reconnectRetries is the actual number of attempts to reconnect.
-func (h *Hook) reconnect(reconnectRetries int) error {
-	if h.protocol == "" || h.address == "" {
-		return fmt.Errorf("Can't reconnect because current configuration doesn't support it")
+// addEventID adds ID returned by EventIDFunc or the default one unless the entry already has it, e.g. if it is fired again.
+func (h *Hook) addEventID(entry *logrus.Entry) {
+	key := h.EventIDKey
+	if key == "" {
+		key = defaultEventIDKey
+	}
+	if _, inMap := entry.Data[key]; inMap {
+		return
 	}
 
-	// Sleep before reconnect.
-	delay := float64(h.ReconnectBaseDelay) * math.Pow(h.ReconnectDelayMultiplier, float64(reconnectRetries))
-	time.Sleep(time.Duration(delay))
+	if h.EventIDFunc != nil {
+		entry.Data[key] = h.EventIDFunc(entry)
+		return
+	}
+	entry.Data[key] = eventID(entry, atomic.AddUint64(&h.eventSeq, 1))
+}
+
+// eventID returns hash of time, level and message of the entry and its sequence number,
+// so identical entries fired one after another get different IDs.
+func eventID(entry *logrus.Entry, seq uint64) string {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d|%d|%s|%d", entry.Time.UnixNano(), entry.Level, entry.Message, seq)
+
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+// addBufferDepth adds the number of entries in async buffer to the entry if IncludeBufferDepth is set.
+func (h *Hook) addBufferDepth(entry *logrus.Entry) {
+	if h.IncludeBufferDepth {
+		addMissingField(entry, h.BufferDepthKey, defaultBufferDepthKey, len(h.fireChannel))
+	}
+}
+
+// stackTrace returns stack trace of the calling goroutine.
+func stackTrace() string {
+	buf := make([]byte, 4096)
+	for {
+		n := runtime.Stack(buf, false)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// uptime returns time since the hook was created or since the package was loaded for hooks created without constructors.
+func (h *Hook) uptime() time.Duration {
+	if h.created.IsZero() {
+		return time.Since(processStart)
+	}
+
+	return time.Since(h.created)
+}
+
+func (h *Hook) isNeedToWaitForBuffer(level logrus.Level) bool {
+	switch h.DeliveryMode {
+	case AtMostOnce:
+		return false
+	case AtLeastOnce:
+		return true
+	}
+
+	switch h.OverflowPolicies[level] {
+	case OverflowBlock:
+		return true
+	case OverflowDrop:
+		return false
+	default:
+		return h.WaitUntilBufferFrees
+	}
+}
+
+// addCorrelationID is called in the logging goroutine so CorrelationIDFunc may rely on its state.
+func (h *Hook) addCorrelationID(entry *logrus.Entry) {
+	if h.CorrelationIDFunc == nil {
+		return
+	}
+
+	key := h.CorrelationIDKey
+	if key == "" {
+		key = defaultCorrelationIDKey
+	}
+
+	if _, inMap := entry.Data[key]; !inMap {
+		entry.Data[key] = h.CorrelationIDFunc()
+	}
+}
+
+func (h *Hook) sendMessage(ctx context.Context, entry *logrus.Entry) error {
+	data, reformat, err := h.prepare(entry, true)
+	if err != nil || data == nil {
+		return err
+	}
+
+	if err := h.performSend(ctx, data, reformat); err != nil {
+		if err == errSpilled {
+			return nil
+		}
+		return err
+	}
+
+	if h.OnSent != nil {
+		h.OnSent(entry, len(data))
+	}
+
+	if h.DeliveryMode == AtLeastOnce && h.fireChannel == nil {
+		// Async worker replays spilled messages itself.
+		h.replaySpill()
+	}
+
+	return nil
+}
+
+// prepareMessage adds hook fields to the entry and returns it formatted and framed for sending.
+// Data is nil if there is nothing to send: for a filtering hook, in dry run mode or if a middleware dropped the entry.
+func (h *Hook) prepareMessage(entry *logrus.Entry) ([]byte, error) {
+	data, _, err := h.prepare(entry, false)
+	return data, err
+}
+
+// prepare works like prepareMessage. If countAttempts is set, the entry is sent with SendAttemptsKey field
+// and reformat returns the message with the given number of attempts, otherwise reformat is nil.
+func (h *Hook) prepare(entry *logrus.Entry, countAttempts bool) (data []byte, reformat func(attempt int) []byte, err error) {
+	// Make sure we always clear the hook only fields from the entry and from the entry returned by middlewares,
+	// the copy made to count attempts is private and keeps them for resending.
+	fired, transformed := entry, entry
+	defer func() {
+		h.filterHookOnly(fired)
+		if transformed != fired {
+			h.filterHookOnly(transformed)
+		}
+	}()
+
+	// Add in the fields from context, providers and the alwaysSentFields. We don't override fields that are already set.
+	h.RLock()
+	extractors := h.contextExtractors
+	providers := h.fieldProviders
+	h.RUnlock()
+	if entry.Context != nil {
+		for _, extractor := range extractors {
+			for k, v := range extractor(entry.Context) {
+				h.RLock()
+				gated := h.isFieldGated(k, entry.Level)
+				h.RUnlock()
+				if _, inMap := entry.Data[k]; !inMap && !gated {
+					entry.Data[k] = v
+				}
+			}
+		}
+	}
+	for _, provider := range providers {
+		k, v := provider()
+		h.RLock()
+		gated := h.isFieldGated(k, entry.Level)
+		h.RUnlock()
+		if _, inMap := entry.Data[k]; !inMap && !gated {
+			entry.Data[k] = v
+		}
+	}
+
+	h.RLock()
+	for k, v := range h.alwaysSentFields {
+		if _, inMap := entry.Data[k]; !inMap && !h.isFieldGated(k, entry.Level) {
+			entry.Data[k] = v
+		}
+	}
+	h.RUnlock()
+
+	if h.IncludeProcess {
+		addMissingField(entry, h.ProcessPIDKey, defaultProcessPIDKey, processPID)
+		addMissingField(entry, h.ProcessNameKey, defaultProcessNameKey, processName)
+	}
+
+	if h.IncludeHostname {
+		addMissingField(entry, h.HostnameKey, defaultHostnameKey, h.hostname())
+	}
+
+	if h.SchemaVersion != "" {
+		addMissingField(entry, h.SchemaVersionKey, defaultSchemaVersionKey, h.SchemaVersion)
+	}
+
+	if h.PartitionKeyFunc != nil {
+		if key := h.PartitionKeyFunc(entry); key != "" {
+			addMissingField(entry, h.PartitionKeyKey, defaultPartitionKeyKey, key)
+		}
+	}
+
+	if h.IncludeLocalAddr {
+		if addr := h.localAddr(); addr != "" {
+			addMissingField(entry, h.LocalAddrKey, defaultLocalAddrKey, addr)
+		}
+	}
+
+	// For a filteringHook, stop here
+	h.RLock()
+	filtering := h.conn == nil && !h.idle
+	h.RUnlock()
+	if filtering && !h.DryRun {
+		return nil, nil, nil
+	}
+
+	h.RLock()
+	middlewares := h.middlewares
+	h.RUnlock()
+	for _, middleware := range middlewares {
+		next, err := middleware(entry)
+		if err != nil {
+			if h.DeadLetter != nil {
+				h.DeadLetter(entry, err)
+			}
+
+			return nil, nil, err
+		}
+		if next == nil {
+			return nil, nil, nil
+		}
+		entry, transformed = next, next
+	}
+
+	// Attempts are counted on a copy of the entry, so other hooks don't see the field
+	// and the formatter applies its options to it like to other fields.
+	countAttempts = countAttempts && h.SendAttemptsKey != ""
+	if countAttempts {
+		if _, inMap := entry.Data[h.SendAttemptsKey]; inMap {
+			countAttempts = false
+		} else {
+			entry = copyEntry(entry)
+			entry.Data[h.SendAttemptsKey] = 1
+		}
+	}
+
+	// Formatter is read once, so the entry is framed for the formatter which formatted it.
+	h.RLock()
+	formatter := h.Formatter
+	h.RUnlock()
+
+	dataBytes, err := h.format(formatter, entry)
+	if err == nil && h.EnvelopeKey != "" {
+		dataBytes, err = h.envelope(dataBytes)
+	}
+	if _, binary := formatter.(*BinaryFormatter); err == nil && binary && h.Framing != LengthPrefixFraming && !h.DryRun {
+		err = fmt.Errorf("Binary documents must be sent with LengthPrefixFraming")
+	}
+	if err == nil && !h.DryRun {
+		err = h.checkCompressFraming()
+	}
+	if err != nil {
+		if h.DeadLetter != nil {
+			h.DeadLetter(entry, err)
+		}
+
+		return nil, nil, err
+	}
+
+	if h.DryRun {
+		return nil, nil, h.writeDryRun(dataBytes)
+	}
+
+	data = h.frame(dataBytes)
+	if h.MaxLineBytes > 0 && len(data) > h.MaxLineBytes {
+		if h.DeadLetter != nil {
+			h.DeadLetter(entry, ErrLineTooLong)
+		}
+
+		return nil, nil, ErrLineTooLong
+	}
+
+	if countAttempts {
+		reformat = func(attempt int) []byte {
+			entry.Data[h.SendAttemptsKey] = attempt
+			return h.reformat(formatter, entry, data)
+		}
+	}
+
+	return data, reformat, nil
+}
+
+// reformat formats the entry again for resending. The previous message is returned
+// if the entry can't be formatted or becomes longer than MaxLineBytes.
+func (h *Hook) reformat(formatter logrus.Formatter, entry *logrus.Entry, previous []byte) []byte {
+	dataBytes, err := h.format(formatter, entry)
+	if err == nil && h.EnvelopeKey != "" {
+		dataBytes, err = h.envelope(dataBytes)
+	}
+	if err != nil {
+		return previous
+	}
+
+	data := h.frame(dataBytes)
+	if h.MaxLineBytes > 0 && len(data) > h.MaxLineBytes {
+		return previous
+	}
+
+	return data
+}
+
+// copyEntry returns copy of the entry with its own fields.
+func copyEntry(entry *logrus.Entry) *logrus.Entry {
+	copied := *entry
+	copied.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		copied.Data[k] = v
+	}
+
+	return &copied
+}
+
+// sendBatch sends entries with a single write.
+func (h *Hook) sendBatch(entries []*logrus.Entry) {
+	var batch []byte
+	sizes := make([]int, len(entries))
+	for i, entry := range entries {
+		data, err := h.prepareMessage(entry)
+		if err != nil {
+			fmt.Println("Error during sending message to logstash:", err)
+			continue
+		}
+		if h.Framing == JSONArrayFraming && len(batch) > 0 && len(data) > 0 {
+			// Merge arrays: [a] and [b] become [a,b].
+			batch = append(batch[:len(batch)-1], ',')
+			data = data[1:]
+		}
+		batch = append(batch, data...)
+		sizes[i] = len(data)
+	}
+
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := h.performSend(context.Background(), batch, nil); err != nil {
+		if err != errSpilled {
+			fmt.Println("Error during sending message to logstash:", err)
+		}
+		return
+	}
+
+	if h.OnSent != nil {
+		for i, entry := range entries {
+			if sizes[i] > 0 {
+				h.OnSent(entry, sizes[i])
+			}
+		}
+	}
+}
+
+// SendRaw sends already formatted message, e.g. forwarded from another source, to logstash
+// with the same resend and reconnect rules as log entries. Newline is appended unless data ends with it
+// and the message is framed as configured. It is sent synchronously even by async hooks.
+func (h *Hook) SendRaw(data []byte) error {
+	if h.isClosed() {
+		return ErrHookClosed
+	}
+	if h.DeliveryMode == AtLeastOnce && h.SpillDir == "" {
+		return ErrSpillDirRequired
+	}
+
+	h.RLock()
+	filtering := h.conn == nil && !h.idle
+	h.RUnlock()
+	if filtering {
+		return nil
+	}
+
+	if err := h.checkCompressFraming(); err != nil {
+		return err
+	}
+
+	if !bytes.HasSuffix(data, []byte{'\n'}) {
+		data = append(data[:len(data):len(data)], '\n')
+	}
+
+	data = h.frame(data)
+	if h.MaxLineBytes > 0 && len(data) > h.MaxLineBytes {
+		return ErrLineTooLong
+	}
+
+	if err := h.performSend(context.Background(), data, nil); err != errSpilled {
+		return err
+	}
+
+	return nil
+}
+
+// frame prepares formatted entry for sending according to Framing.
+func (h *Hook) frame(data []byte) []byte {
+	switch h.Framing {
+	case LengthPrefixFraming:
+		data = bytes.TrimSuffix(data, []byte{'\n'})
+		framed := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint32(framed, uint32(len(data)))
+		copy(framed[4:], data)
+
+		return framed
+	case JSONArrayFraming:
+		data = bytes.TrimSuffix(data, []byte{'\n'})
+		framed := make([]byte, 0, len(data)+2)
+		framed = append(framed, '[')
+		framed = append(framed, data...)
+
+		return append(framed, ']')
+	default:
+		return data
+	}
+}
+
+// hostname returns HostnameFunc result or the host name reported by the kernel.
+func (h *Hook) hostname() string {
+	if h.HostnameFunc != nil {
+		return h.HostnameFunc()
+	}
+
+	return hostname
+}
+
+// addMissingField sets the field unless the entry already has it. defaultKey is used if key is empty.
+func addMissingField(entry *logrus.Entry, key, defaultKey string, value interface{}) {
+	if key == "" {
+		key = defaultKey
+	}
+
+	if _, inMap := entry.Data[key]; !inMap {
+		entry.Data[key] = value
+	}
+}
+
+// localAddr returns local address of the current connection, so it changes after reconnect.
+func (h *Hook) localAddr() string {
+	h.RLock()
+	defer h.RUnlock()
+
+	if h.conn == nil || h.conn.LocalAddr() == nil {
+		return ""
+	}
+
+	return h.conn.LocalAddr().String()
+}
+
+// writeDryRun writes formatted entry to DryRunWriter instead of the connection.
+func (h *Hook) writeDryRun(data []byte) error {
+	w := h.DryRunWriter
+	if w == nil {
+		w = os.Stdout
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+// prefixFormatter is implemented by formatters which are able to remove the hook prefix from keys.
+type prefixFormatter interface {
+	FormatWithPrefix(entry *logrus.Entry, prefix string) ([]byte, error)
+}
+
+// format serializes entry with the configured formatter.
+// Without custom formatter entry is formatted by LogstashFormatter using appName and TimeFormat.
+// They are also used by custom LogstashFormatter which doesn't set its own Type and TimestampFormat.
+// Type returned by TypeRouter overrides both of them.
+func (h *Hook) format(formatter logrus.Formatter, entry *logrus.Entry) ([]byte, error) {
+	if formatter == nil {
+		formatter = &LogstashFormatter{}
+	}
+
+	var routedType string
+	if h.TypeRouter != nil {
+		routedType = h.TypeRouter(entry)
+	}
+
+	if f, ok := formatter.(*LogstashFormatter); ok && (f.Type == "" || f.TimestampFormat == "" || routedType != "") {
+		logstashFormatter := *f
+		if routedType != "" {
+			logstashFormatter.Type = routedType
+		}
+		if logstashFormatter.Type == "" {
+			logstashFormatter.Type = h.appName
+		}
+		if logstashFormatter.Type == "" && h.AppNameFromProcess {
+			logstashFormatter.Type = processName
+		}
+		if logstashFormatter.TimestampFormat == "" {
+			logstashFormatter.TimestampFormat = h.TimeFormat
+		}
+		formatter = &logstashFormatter
+	}
+
+	if f, ok := formatter.(prefixFormatter); ok {
+		return f.FormatWithPrefix(entry, h.hookOnlyPrefix)
+	}
+
+	return formatter.Format(entry)
+}
 
-	conn, err := gas.Dial(h.protocol, h.address)
+// envelope wraps JSON document under EnvelopeKey with top-level fields from EnvelopeFields and EnvelopeProvider.
+func (h *Hook) envelope(document []byte) ([]byte, error) {
+	envelope := make(map[string]interface{}, len(h.EnvelopeFields)+1)
+	for k, v := range h.EnvelopeFields {
+		envelope[k] = v
+	}
+	if h.EnvelopeProvider != nil {
+		for k, v := range h.EnvelopeProvider() {
+			envelope[k] = v
+		}
+	}
+	envelope[h.EnvelopeKey] = json.RawMessage(bytes.TrimSuffix(document, []byte{'\n'}))
 
-	// Oops. Can't connect. No problem. Let's try again.
+	serialized, err := json.Marshal(envelope)
 	if err != nil {
-		if !h.isNeedToReconnect(reconnectRetries) {
-			// We have reached limit of re-connections.
+		return nil, fmt.Errorf("Failed to wrap document in envelope, %v", err)
+	}
+
+	return append(serialized, '\n'), nil
+}
+
+// performSend tries to send data resending it and reconnecting as the backoff strategy decides.
+// Resent messages are made by reformat if it isn't nil, e.g. to update SendAttemptsKey field.
+// Message content is dumped to a temporary file if it couldn't be sent, with AtLeastOnce it is saved to SpillDir instead.
+func (h *Hook) performSend(ctx context.Context, data []byte, reformat func(attempt int) []byte) error {
+	// Messages are shed while reconnecting in background, they'd be dropped by the full buffer anyway.
+	err := h.waitReconnect(ctx)
+	if err == nil {
+		err = h.sendWithRetries(ctx, data, reformat)
+	}
+
+	if err != nil && h.DeliveryMode == AtLeastOnce && h.SpillDir != "" {
+		spillErr := h.appendSpill(data)
+		if spillErr == nil {
+			return errSpilled
+		}
+		fmt.Println("Couldn't spill message to disk:", spillErr)
+	}
+
+	if err != nil && err != ErrReconnecting {
+		file := fmt.Sprintf("/tmp/logrustash-%d.tmp", time.Now().UnixNano())
+		ioutil.WriteFile(file, data, 0644)
+		fmt.Printf("Wrote message content to %s\n", file)
+	}
+
+	return err
+}
+
+func (h *Hook) sendWithRetries(ctx context.Context, data []byte, reformat func(attempt int) []byte) error {
+	// retryCtx is done when the caller's ctx is done or RetryBudget is exhausted.
+	retryCtx := ctx
+	if h.RetryBudget > 0 {
+		var cancel context.CancelFunc
+		retryCtx, cancel = context.WithTimeout(ctx, h.RetryBudget)
+		defer cancel()
+	}
+
+	// sendRetries is the actual number of attempts to resend message.
+	sendRetries := 0
+	for attempt := 1; ; attempt++ {
+		payload := data
+		if attempt > 1 && reformat != nil {
+			payload = reformat(attempt)
+		}
+		payload = h.compress(payload)
+
+		err := h.write(payload)
+		if err == nil {
+			h.Lock()
+			h.consecutiveFailures = 0
+			h.Unlock()
+
+			return nil
+		}
+
+		// Resending over the same connection after a partial write would append
+		// the message to its fragment, so it is only resent over a new connection.
+		_, partial := err.(partialWriteError)
+		if partial {
+			h.dropConn()
+		}
+
+		if retryCtx.Err() != nil && ctx.Err() == nil {
+			return fmt.Errorf("Retry budget of %s is exhausted: %s", h.RetryBudget, err)
+		}
+
+		backoff := h.backoff()
+		if h.DeliveryMode == AtMostOnce {
+			if (partial || backoff.ShouldReconnect(err, 0)) && h.protocol != "" && h.address != "" {
+				h.reconnectInBackground()
+			}
+
+			return err
+		}
+
+		if !partial && backoff.ShouldRetry(err, sendRetries) {
+			// The delay is waited here rather than in write, so the hook isn't locked meanwhile.
+			if delay := retryDelay(err); delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-retryCtx.Done():
+					timer.Stop()
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					return fmt.Errorf("Retry budget of %s is exhausted: %s", h.RetryBudget, err)
+				}
+			}
+			sendRetries++
+			continue
+		}
+
+		if !backoff.ShouldReconnect(err, 0) && !h.failureThresholdReached() {
 			return err
 		}
 
-		return h.reconnect(reconnectRetries + 1)
+		if h.AsyncReconnect && h.fireChannel != nil {
+			h.reconnectInBackground()
+
+			return ErrReconnecting
+		}
+
+		var reconnectErr error
+		if h.startReconnect(false) {
+			reconnectErr = h.reconnect(retryCtx)
+			h.finishReconnect()
+		} else {
+			// Another goroutine replaces the connection, the message is resent over the new one.
+			reconnectErr = h.waitReconnect(retryCtx)
+			if reconnectErr == ErrReconnecting {
+				return reconnectErr
+			}
+		}
+		if reconnectErr != nil {
+			if reconnectErr == ctx.Err() {
+				return reconnectErr
+			}
+			if reconnectErr == retryCtx.Err() {
+				return fmt.Errorf("Retry budget of %s is exhausted: %s", h.RetryBudget, err)
+			}
+			return fmt.Errorf("Couldn't reconnect to logstash: %s. The reason of reconnect: %s", reconnectErr, err)
+		}
+		sendRetries = 0
+	}
+}
+
+// compress gzips payload of a write if Compress is set. HTTP requests are compressed as a whole,
+// messages of other connections are compressed inside their length prefix frames, so the stream stays delimited.
+// Payloads and messages smaller than CompressMinSize are sent as is, receiver tells them apart by the gzip magic number.
+func (h *Hook) compress(data []byte) []byte {
+	if !h.Compress {
+		return data
+	}
+	if h.sendsHTTP() {
+		return h.gzip(data)
+	}
+	if h.Framing != LengthPrefixFraming {
+		return data
+	}
+
+	compressed := make([]byte, 0, len(data))
+	for len(data) >= 4 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size > len(data)-4 {
+			break
+		}
+		doc := h.gzip(data[4 : 4+size])
+		compressed = append(compressed, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(compressed[len(compressed)-4:], uint32(len(doc)))
+		compressed = append(compressed, doc...)
+		data = data[4+size:]
+	}
+
+	return append(compressed, data...)
+}
+
+// gzip compresses data unless it is smaller than CompressMinSize.
+func (h *Hook) gzip(data []byte) []byte {
+	if len(data) < h.CompressMinSize {
+		return data
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return data
+	}
+	if err := zw.Close(); err != nil {
+		return data
+	}
+
+	return buf.Bytes()
+}
+
+// checkCompressFraming returns error if Compress is set for a stream which messages can't be delimited
+// after compression: gzip output may contain newlines.
+func (h *Hook) checkCompressFraming() error {
+	if h.Compress && h.Framing != LengthPrefixFraming && !h.sendsHTTP() {
+		return errCompressFraming
+	}
+
+	return nil
+}
+
+// sendsHTTP reports whether messages are posted over HTTP, so each write is a separate request.
+func (h *Hook) sendsHTTP() bool {
+	h.RLock()
+	defer h.RUnlock()
+
+	_, ok := h.conn.(*httpConn)
+	return ok || h.protocol == "http"
+}
+
+// isGzip reports whether data starts with gzip magic number.
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// failureThresholdReached counts a failed send and reports whether ReconnectAfterFailures sends failed in a row.
+func (h *Hook) failureThresholdReached() bool {
+	if h.ReconnectAfterFailures <= 0 {
+		return false
 	}
 
 	h.Lock()
-	h.conn = conn
+	defer h.Unlock()
+
+	h.consecutiveFailures++
+	if h.consecutiveFailures < h.ReconnectAfterFailures {
+		return false
+	}
+	h.consecutiveFailures = 0
+
+	return true
+}
+
+// reconnectInBackground starts reconnect unless it is already in progress.
+// The new connection is closed if the hook was closed in the meantime.
+func (h *Hook) reconnectInBackground() {
+	if !h.startReconnect(true) {
+		return
+	}
+
+	go func() {
+		err := h.reconnect(context.Background())
+
+		h.Lock()
+		h.clearReconnect()
+		closed := h.isClosed()
+		if err == nil && closed {
+			h.conn.Close()
+		}
+		h.Unlock()
+
+		if err != nil {
+			fmt.Println("Couldn't reconnect to logstash:", err)
+		}
+	}()
+}
+
+// startReconnect marks the hook as reconnecting, so only one goroutine replaces the connection at a time.
+// Messages sent meanwhile wait for the reconnect or, if it is in background, are dropped with ErrReconnecting.
+// It returns false if reconnect is already in progress.
+func (h *Hook) startReconnect(background bool) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.reconnecting {
+		return false
+	}
+	h.reconnecting = true
+	h.reconnectBackground = background
+	h.reconnectDone = make(chan struct{})
+
+	return true
+}
+
+// finishReconnect clears the mark set by startReconnect and wakes up the waiting messages.
+func (h *Hook) finishReconnect() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.clearReconnect()
+}
+
+// clearReconnect works like finishReconnect. It must be called with the hook locked.
+func (h *Hook) clearReconnect() {
+	h.reconnecting = false
+	h.reconnectBackground = false
+	close(h.reconnectDone)
+}
+
+// waitReconnect waits until reconnect in progress finishes or ctx is done.
+// It returns ErrReconnecting without waiting if the reconnect is in background.
+func (h *Hook) waitReconnect(ctx context.Context) error {
+	h.RLock()
+	reconnecting, background, done := h.reconnecting, h.reconnectBackground, h.reconnectDone
+	h.RUnlock()
+
+	switch {
+	case !reconnecting:
+		return nil
+	case background:
+		return ErrReconnecting
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Hook) isReconnecting() bool {
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.reconnecting
+}
+
+// isClosed reports whether the hook was closed.
+func (h *Hook) isClosed() bool {
+	return atomic.LoadInt32(&h.closed) == 1
+}
+
+// write makes a single attempt to write data to the connection.
+func (h *Hook) write(data []byte) error {
+	// The connection is prepared and written under one lock, so reconnect can't replace it in between.
+	h.Lock()
+	if err := h.prepareWrite(); err != nil {
+		h.Unlock()
+		return err
+	}
+
+	start := time.Now()
+	n, err := writeAll(h.conn, data)
+	latency := time.Since(start)
+	h.bytesSent += uint64(n)
+	h.lastSendLatency = latency
+	h.lastWrite = time.Now()
+	h.scheduleIdleClose()
 	h.Unlock()
 
+	if h.OnWrite != nil {
+		h.OnWrite(n, latency)
+	}
+
+	if err != nil && n > 0 {
+		return partialWriteError{err: err, written: n}
+	}
+
+	return err
+}
+
+// prepareWrite dials, sets write deadline and prepares the connection for the next write.
+// It must be called with the hook locked.
+func (h *Hook) prepareWrite() error {
+	if err := h.wakeConn(); err != nil {
+		return err
+	}
+
+	if h.Timeout > 0 {
+		if err := h.setWriteDeadline(); err != nil {
+			return err
+		}
+	}
+
+	return h.prepareConn()
+}
+
+// wakeConn dials logstash if the connection was closed by IdleTimeout or wasn't dialed yet.
+// It must be called with the hook locked.
+func (h *Hook) wakeConn() error {
+	if !h.idle {
+		return nil
+	}
+
+	conn, err := h.dial()
+	if err != nil {
+		return err
+	}
+	h.replaceConn(conn)
+
 	return nil
 }
 
-func (h *Hook) isNeedToResendMessage(err net.Error, sendRetries int) bool {
-	return (err.Temporary() || err.Timeout()) && sendRetries < h.MaxSendRetries
+// scheduleIdleClose restarts IdleTimeout countdown. It must be called with the hook locked.
+func (h *Hook) scheduleIdleClose() {
+	if h.IdleTimeout <= 0 || h.protocol == "" || h.address == "" {
+		return
+	}
+
+	if h.idleTimer == nil {
+		h.idleTimer = time.AfterFunc(h.IdleTimeout, h.closeIdleConn)
+		return
+	}
+	h.idleTimer.Reset(h.IdleTimeout)
+}
+
+// closeIdleConn closes the connection if nothing was written to it for IdleTimeout.
+func (h *Hook) closeIdleConn() {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.idle || h.conn == nil || h.isClosed() {
+		return
+	}
+	if wait := h.IdleTimeout - time.Since(h.lastWrite); wait > 0 {
+		// Timer fired while a write held the lock.
+		h.idleTimer.Reset(wait)
+		return
+	}
+
+	h.conn.Close()
+	h.idle = true
+}
+
+// shortWriteError is returned when connection accepts no data without reporting error.
+// It is temporary so the message is resent by default.
+type shortWriteError struct{}
+
+func (shortWriteError) Error() string   { return "short write: connection accepted no data" }
+func (shortWriteError) Timeout() bool   { return false }
+func (shortWriteError) Temporary() bool { return true }
+
+// partialWriteError is returned when connection fails after a part of the message is written.
+type partialWriteError struct {
+	err     error
+	written int
+}
+
+func (e partialWriteError) Error() string {
+	return fmt.Sprintf("connection failed after writing %d bytes: %s", e.written, e.err)
+}
+func (partialWriteError) Timeout() bool   { return false }
+func (partialWriteError) Temporary() bool { return false }
+
+// writeAll writes data continuing after partial writes until all data is written,
+// an error occurs or the connection makes no progress.
+func writeAll(conn net.Conn, data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		n, err := conn.Write(data[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, shortWriteError{}
+		}
+	}
+
+	return written, nil
+}
+
+// BytesSent returns the number of bytes written to logstash connections.
+func (h *Hook) BytesSent() uint64 {
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.bytesSent
 }
 
-func (h *Hook) isNeedToReconnect(reconnectRetries int) bool {
-	return reconnectRetries < h.MaxReconnectRetries
+// LastSendLatency returns duration of the last write to logstash connection.
+func (h *Hook) LastSendLatency() time.Duration {
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.lastSendLatency
+}
+
+// setWriteDeadline applies Timeout to the connection.
+// Connections which don't support deadlines are used without them unless RequireWriteDeadline is set.
+// It must be called with the hook locked.
+func (h *Hook) setWriteDeadline() error {
+	if h.deadlineUnsupported {
+		return nil
+	}
+
+	err := h.conn.SetWriteDeadline(time.Now().Add(h.Timeout))
+	if err == nil {
+		return nil
+	}
+
+	if h.RequireWriteDeadline {
+		return fmt.Errorf("Couldn't set write deadline: %s", err)
+	}
+
+	// Don't try again for this connection and don't spam the output.
+	h.deadlineUnsupported = true
+	fmt.Println("Connection doesn't support write deadline, sending without timeout:", err)
+
+	return nil
+}
+
+// backoff returns the configured strategy or the exponential one built from the hook options.
+func (h *Hook) backoff() BackoffStrategy {
+	if h.Backoff != nil {
+		return h.Backoff
+	}
+
+	backoff := ExponentialBackoff{
+		BaseDelay:           h.ReconnectBaseDelay,
+		Multiplier:          h.ReconnectDelayMultiplier,
+		MaxSendRetries:      h.MaxSendRetries,
+		MaxReconnectRetries: h.MaxReconnectRetries,
+	}
+	switch h.DeliveryMode {
+	case AtMostOnce:
+		backoff.MaxSendRetries = 0
+		if backoff.MaxReconnectRetries == 0 {
+			backoff.MaxReconnectRetries = 1
+		}
+	case AtLeastOnce:
+		if backoff.MaxSendRetries == 0 {
+			backoff.MaxSendRetries = defaultDeliveryRetries
+		}
+		if backoff.MaxReconnectRetries == 0 {
+			backoff.MaxReconnectRetries = defaultDeliveryRetries
+		}
+	}
+	if h.ClassifyError != nil {
+		return classifiedBackoff{backoff, h.ClassifyError}
+	}
+
+	return backoff
+}
+
+// TODO Check reconnect for NOT ASYNC mode.
+// The hook will reconnect to Logstash several times with sleep duration between each reconnect attempt
+// determined by the backoff strategy. By default it is calculated as product of ReconnectBaseDelay
+// by ReconnectDelayMultiplier to the power of the number of attempts made.
+// Every attempt dials the configured hostname, so a Logstash moved behind a DNS record is picked up.
+// Reconnect is aborted with the error of ctx when it is done.
+func (h *Hook) reconnect(ctx context.Context) error {
+	if h.protocol == "" || h.address == "" {
+		return fmt.Errorf("Can't reconnect because current configuration doesn't support it")
+	}
+
+	backoff := h.backoff()
+
+	// reconnectRetries is the actual number of attempts to reconnect.
+	for reconnectRetries := 0; ; reconnectRetries++ {
+		// Sleep before reconnect.
+		timer := time.NewTimer(backoff.NextDelay(reconnectRetries))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		conn, err := h.dial()
+		if err == nil && h.ValidateConn != nil {
+			if validateErr := h.ValidateConn(conn); validateErr != nil {
+				conn.Close()
+				err = connValidationError{validateErr}
+			}
+		}
+		if err == nil {
+			h.Lock()
+			err = h.startConn(conn)
+			h.Unlock()
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			h.markSpillPending()
+
+			return nil
+		}
+
+		// Oops. Can't connect. No problem. Let's try again.
+		if !backoff.ShouldReconnect(err, reconnectRetries+1) {
+			return err
+		}
+	}
+}
+
+// connValidationError is returned when connection dialed by reconnect fails ValidateConn.
+// It is a net error requiring reconnect, so another connection is dialed by default.
+type connValidationError struct {
+	err error
+}
+
+func (e connValidationError) Error() string {
+	return fmt.Sprintf("connection failed validation: %s", e.err)
+}
+func (connValidationError) Timeout() bool   { return false }
+func (connValidationError) Temporary() bool { return false }
+
+// StartHealthCheck starts probing the connection in background every HealthCheckInterval.
+// If logstash closed the connection, the hook reconnects before the next message is sent, so it isn't
+// delayed by reconnect. It should be called once after HealthCheckInterval is set. Close stops probing.
+func (h *Hook) StartHealthCheck() {
+	h.backgroundMu.Lock()
+	defer h.backgroundMu.Unlock()
+
+	if h.HealthCheckInterval <= 0 || h.healthCheckStop != nil {
+		return
+	}
+	h.healthCheckStop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(h.HealthCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				h.checkHealth(stop)
+			case <-stop:
+				return
+			}
+		}
+	}(h.healthCheckStop)
+}
+
+// stopBackground stops the health check and summary goroutines.
+func (h *Hook) stopBackground() {
+	// The hook lock may be held by the worker blocked in write.
+	h.backgroundMu.Lock()
+	defer h.backgroundMu.Unlock()
+
+	if h.healthCheckStop != nil {
+		close(h.healthCheckStop)
+	}
+	if h.summaryStop != nil {
+		close(h.summaryStop)
+	}
+}
+
+// checkHealth reconnects if the connection is closed by logstash.
+func (h *Hook) checkHealth(stop chan struct{}) {
+	h.RLock()
+	conn := h.conn
+	idle := h.idle
+	h.RUnlock()
+
+	if conn == nil || idle || h.isReconnecting() || isConnAlive(conn) {
+		return
+	}
+
+	if !h.startReconnect(false) {
+		return
+	}
+	h.RLock()
+	replaced := h.conn != conn
+	h.RUnlock()
+	if replaced {
+		// Connection was replaced by reconnect after failed send meanwhile.
+		h.finishReconnect()
+		return
+	}
+
+	err := h.reconnect(context.Background())
+	h.finishReconnect()
+	if err != nil {
+		fmt.Println("Couldn't reconnect to logstash:", err)
+		return
+	}
+	conn.Close()
+
+	select {
+	case <-stop:
+		// The hook was closed during reconnect.
+		h.closeConn()
+	default:
+	}
+}
+
+// isConnAlive probes the connection with a short read. Logstash doesn't send anything,
+// so the read times out on a live connection and fails if the connection is closed.
+// HTTP connections are always alive because each message is a separate request.
+func isConnAlive(conn net.Conn) bool {
+	if _, ok := conn.(*httpConn); ok {
+		return true
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return true
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, err := conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+
+	return err == nil
+}
+
+// setConn replaces the connection and resets the state related to the previous one.
+func (h *Hook) setConn(conn net.Conn) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.replaceConn(conn)
+}
+
+// replaceConn works like setConn. It must be called with the hook locked.
+func (h *Hook) replaceConn(conn net.Conn) {
+	h.conn = conn
+	h.deadlineUnsupported = false
+	h.connPrepared = false
+	h.idle = false
+}
+
+// startConn replaces the connection and prepares it right away, so ConnectHeader is sent even if no message
+// follows, e.g. after reconnect by the health check. It must be called with the hook locked.
+func (h *Hook) startConn(conn net.Conn) error {
+	h.replaceConn(conn)
+
+	if h.Timeout > 0 {
+		if err := h.setWriteDeadline(); err != nil {
+			return err
+		}
+	}
+
+	return h.prepareConn()
+}
+
+// keepAliveConn is implemented by TCP connections.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+type writeBufferConn interface {
+	SetWriteBuffer(bytes int) error
+}
+
+// prepareConn applies connection options and writes ConnectHeader before the first write to a new connection
+// unless it was done when the connection was established.
+// It must be called with the hook locked.
+func (h *Hook) prepareConn() error {
+	if h.connPrepared {
+		return nil
+	}
+
+	if h.KeepAlivePeriod > 0 {
+		if conn, ok := h.conn.(keepAliveConn); ok {
+			if err := conn.SetKeepAlive(true); err != nil {
+				fmt.Println("Couldn't enable keepalive:", err)
+			} else if err := conn.SetKeepAlivePeriod(h.KeepAlivePeriod); err != nil {
+				fmt.Println("Couldn't set keepalive period:", err)
+			}
+		}
+	}
+
+	if h.WriteBufferSize > 0 {
+		if conn, ok := h.conn.(writeBufferConn); ok {
+			if err := conn.SetWriteBuffer(h.WriteBufferSize); err != nil {
+				fmt.Println("Couldn't set write buffer size:", err)
+			}
+		}
+	}
+
+	if len(h.ConnectHeader) > 0 {
+		if n, err := writeAll(h.conn, h.ConnectHeader); err != nil {
+			if n > 0 {
+				return partialWriteError{err: err, written: n}
+			}
+			return err
+		}
+	}
+	h.connPrepared = true
+
+	return nil
+}
+
+// dial opens a new connection to logstash.
+// The address is passed as it was configured, so hostnames are resolved on each dial.
+// Protocol tls dials over TLS verifying certificate of logstash against the host name.
+func (h *Hook) dial() (net.Conn, error) {
+	switch {
+	case h.dialFunc != nil:
+		return h.dialFunc(h.protocol, h.address)
+	case h.protocol == "tls":
+		dialer := h.Dialer
+		if dialer == nil {
+			dialer = &net.Dialer{}
+		}
+		return tls.DialWithDialer(dialer, "tcp", h.address, nil)
+	case h.Dialer != nil:
+		return h.Dialer.Dial(h.protocol, h.address)
+	}
+
+	return gas.Dial(h.protocol, h.address)
 }
 
 // Levels specifies "active" log levels.
@@ -1,23 +1,179 @@
 package logrustash
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/sirupsen/logrus"
 )
 
-const defaultTimestampFormat = time.RFC3339
+const (
+	defaultTimestampFormat = time.RFC3339
+	defaultServiceNameKey  = "service.name"
+	defaultTypeKey         = "type"
+)
+
+// ReservedKey is a set of reserved fields added by LogstashFormatter.
+type ReservedKey uint8
+
+// Reserved fields.
+const (
+	ReservedVersion   ReservedKey = 1 << iota // @version field.
+	ReservedTimestamp                         // @timestamp field.
+	ReservedMessage                           // message field.
+	ReservedLevel                             // level field.
+	ReservedType                              // type field, it is sent only if Type is set.
+
+	AllReservedKeys = ReservedVersion | ReservedTimestamp | ReservedMessage | ReservedLevel | ReservedType
+)
+
+// NonFiniteFloats declares how NaN and infinite float fields are sent. JSON has no numbers for them.
+type NonFiniteFloats int
+
+// Ways to send NaN and infinite floats.
+const (
+	NonFiniteAsNull   NonFiniteFloats = iota // Send null.
+	NonFiniteAsString                        // Send "NaN", "+Inf" or "-Inf".
+	NonFiniteAsError                         // Fail to format the entry.
+)
 
 // LogstashFormatter generates json in logstash format.
 // Logstash site: http://logstash.net/
 type LogstashFormatter struct {
-	Type string // if not empty use for logstash type field.
+	// Type is sent in logstash type field if it isn't empty. Date patterns like "logs-%{+YYYY.MM.dd}" are expanded
+	// with UTC time of the entry, as in logstash, e.g. to route entries to daily indices.
+	Type string
+
+	// TypeKey is a key under which Type is sent, e.g. "service.type" for schemas where type is reserved.
+	// Type is sent as "type" if it is empty. Exclude ReservedType from ReservedKeys to omit it.
+	TypeKey string
+
+	// TypeOverrideKey is a key of entry field, e.g. "@type", which overrides Type for the entry,
+	// so one connection may carry several document types. The field itself isn't sent.
+	TypeOverrideKey string
+
+	// ServiceName is sent under ServiceNameKey ("service.name" by default) if it isn't empty.
+	// Unlike Type it isn't used for index routing and doesn't default to the hook app name.
+	ServiceName    string
+	ServiceNameKey string
 
 	// TimestampFormat sets the format used for timestamps.
 	TimestampFormat string
+
+	// DurationUnit renders time.Duration fields as a float number of the unit,
+	// e.g. time.Millisecond. Durations are rendered in nanoseconds if it is zero.
+	DurationUnit time.Duration
+
+	// FormatTimeFields renders time.Time fields with TimestampFormat instead of RFC3339Nano.
+	FormatTimeFields bool
+
+	// Options for entries with empty message. They are applied in the following order:
+	// MessageFallbackKey moves the field with this key to message,
+	// EmptyMessagePlaceholder is used as message,
+	// OmitEmptyMessage drops message field.
+	MessageFallbackKey      string
+	EmptyMessagePlaceholder string
+	OmitEmptyMessage        bool
+
+	// OmitMessageLevels lists levels for which message field isn't sent, e.g. to keep PII
+	// of low-severity messages out of logstash. Other fields are sent as usual.
+	OmitMessageLevels []logrus.Level
+
+	// RawLevelKey sends logrus level number under this key if it isn't empty.
+	RawLevelKey string
+
+	// RelocateTimeField sends "time" field as "fields.time", like message, level and type fields,
+	// for setups which treat "time" field as timestamp. It is sent as is by default.
+	RelocateTimeField bool
+
+	// FlattenFields sends fields with map and struct values as dotted keys, e.g. {"a":{"b":1}} as {"a.b":1}.
+	FlattenFields bool
+
+	// MaxFields limits the number of entry fields. Excess fields are dropped in key order
+	// and their count is sent in fields_dropped. Reserved fields aren't counted, neither are entry fields
+	// named as them, e.g. message, which are always sent prefixed with "fields.". No limit if it is zero.
+	MaxFields int
+
+	// StructuredErrors sends error fields as objects with message and type (e.g. "*os.PathError") keys
+	// instead of a single string. Errors wrapped by them are sent in chain key the same way.
+	StructuredErrors bool
+
+	// FieldTypes converts values of the fields to declared types: "string", "int", "float" or "bool",
+	// e.g. {"status": "string"}, so a field doesn't get conflicting mappings in Elasticsearch.
+	// Values which can't be converted are sent as is.
+	FieldTypes map[string]string
+
+	// MaxFieldValueLength truncates string fields longer than this many bytes. The ellipsis appended to them
+	// counts toward the limit, it is left out if the limit is shorter than the ellipsis.
+	// Keys of truncated fields are sent in truncated_fields. No limit if it is zero.
+	MaxFieldValueLength int
+
+	// MaxArrayLength keeps only the first this many elements of slice and array fields, e.g. to protect
+	// nested field mappings. Original lengths of capped fields are sent in capped_fields by key.
+	// []byte fields aren't capped. No limit if it is zero.
+	MaxArrayLength int
+
+	// MaxDocumentBytes limits the size of serialized document. The largest fields are removed
+	// and the message is truncated until it fits, their keys are sent in pruned_fields.
+	// No limit if it is zero.
+	MaxDocumentBytes int
+
+	// MaxSafeInt sends integer fields with absolute value above it as strings, e.g. 1<<53 - 1 keeps
+	// int64 IDs precise for parsers which read numbers as float64. Integers are sent as is if it is zero.
+	MaxSafeInt uint64
+
+	// BytesAsString sends []byte fields holding valid UTF-8 as strings instead of base64.
+	BytesAsString bool
+
+	// ReservedKeys selects reserved fields to send, e.g. ReservedTimestamp | ReservedMessage.
+	// Entry fields named as excluded reserved fields are still sent prefixed with "fields.".
+	// All reserved fields are sent if it is zero.
+	ReservedKeys ReservedKey
+
+	// HMACKey adds hmac field with hex encoded HMAC-SHA256 of the document computed with this key.
+	// The field is added to the end of the document, so the signed payload is the document
+	// with `,"hmac":"..."` removed. Entry field named hmac is sent as fields.hmac.
+	HMACKey []byte
+
+	// CallerPackageKey sends package of the function which logged the entry under this key,
+	// e.g. "caller.package", if the entry has caller (see logrus ReportCaller). Disabled if empty.
+	CallerPackageKey string
+
+	// DereferencePointers sends values of pointer fields, e.g. *string or *time.Time, as values they point to,
+	// so the other options apply to them. Pointers implementing error or json.Marshaler with pointer receiver are sent as is.
+	DereferencePointers bool
+
+	// OmitNilPointers drops fields with nil pointers instead of sending them as null.
+	OmitNilPointers bool
+
+	// FloatPrecision rounds float fields to this many significant digits, e.g. 6 sends 1.1000000000000001 as 1.1,
+	// so documents don't depend on float representation. Floats are sent with full precision if it is zero.
+	FloatPrecision int
+
+	// NonFiniteFloats declares how NaN and infinite float fields are sent. They are sent as null by default.
+	NonFiniteFloats NonFiniteFloats
+}
+
+// unprunableFields are kept when the document is pruned to MaxDocumentBytes.
+var unprunableFields = map[string]bool{
+	"@version":         true,
+	"@timestamp":       true,
+	"level":            true,
+	"type":             true,
+	"pruned_fields":    true,
+	"truncated_fields": true,
+	"capped_fields":    true,
 }
 
 // Format formats log message.
@@ -27,59 +183,803 @@ func (f *LogstashFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 
 // FormatWithPrefix removes prefix from keys and formats log message.
 func (f *LogstashFormatter) FormatWithPrefix(entry *logrus.Entry, prefix string) ([]byte, error) {
+	timeStampFormat := f.TimestampFormat
+
+	if timeStampFormat == "" {
+		timeStampFormat = defaultTimestampFormat
+	}
+
+	var serialized []byte
+	var err error
+	if f.canFormatFast(entry, prefix) {
+		serialized, err = f.formatFast(entry, timeStampFormat)
+	} else {
+		serialized, err = f.format(entry, prefix, timeStampFormat)
+	}
+	if err != nil || len(f.HMACKey) == 0 {
+		return serialized, err
+	}
+
+	return f.sign(serialized), nil
+}
+
+// sign adds hmac field with HMAC-SHA256 of the serialized fields as the last field of the document.
+func (f *LogstashFormatter) sign(serialized []byte) []byte {
+	payload := bytes.TrimSuffix(serialized, []byte{'\n'})
+
+	mac := hmac.New(sha256.New, f.HMACKey)
+	mac.Write(payload)
+	sum := hex.EncodeToString(mac.Sum(nil))
+
+	signed := make([]byte, 0, len(payload)+len(sum)+12)
+	signed = append(signed, payload[:len(payload)-1]...)
+	if len(payload) > 2 {
+		signed = append(signed, ',')
+	}
+	signed = append(signed, `"hmac":"`...)
+	signed = append(signed, sum...)
+
+	return append(signed, "\"}\n"...)
+}
+
+// format copies entry fields applying the options and adds reserved fields.
+func (f *LogstashFormatter) format(entry *logrus.Entry, prefix, timeStampFormat string) ([]byte, error) {
 	fields := make(logrus.Fields)
 	for k, v := range entry.Data {
 		// Remove the prefix when sending the fields to logstash
-		if prefix != "" && strings.HasPrefix(k, prefix) {
-			k = strings.TrimPrefix(k, prefix)
+		k, ok := trimPrefix(entry.Data, k, prefix)
+		if !ok {
+			continue
+		}
+
+		if f.DereferencePointers || f.OmitNilPointers {
+			var isNil bool
+			if v, isNil = f.dereference(v); isNil && f.OmitNilPointers {
+				continue
+			}
 		}
 
 		switch v := v.(type) {
 		case error:
+			if f.StructuredErrors {
+				fields[k] = decomposeError(v)
+				break
+			}
 			// Otherwise errors are ignored by `encoding/json`
 			// https://github.com/Sirupsen/logrus/issues/377
 			fields[k] = v.Error()
+		case float32, float64:
+			fields[k] = f.roundFloat(f.replaceNonFinite(v))
+		case []byte:
+			if f.BytesAsString && utf8.Valid(v) {
+				fields[k] = string(v)
+			} else {
+				fields[k] = v
+			}
+		case time.Duration:
+			if f.DurationUnit > 0 {
+				fields[k] = float64(v) / float64(f.DurationUnit)
+			} else {
+				fields[k] = v
+			}
+		case time.Time:
+			if f.FormatTimeFields {
+				fields[k] = v.Format(timeStampFormat)
+			} else {
+				fields[k] = v
+			}
 		default:
-			fields[k] = v
+			if s, ok := f.formatLargeInt(v); ok {
+				fields[k] = s
+			} else {
+				fields[k] = v
+			}
 		}
 	}
 
-	fields["@version"] = "1"
+	for k, typ := range f.FieldTypes {
+		if v, ok := fields[k]; ok {
+			converted, err := convertField(v, typ)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to convert field %s, %v", k, err)
+			}
+			fields[k] = converted
+		}
+	}
 
-	timeStampFormat := f.TimestampFormat
+	typ := f.Type
+	if f.TypeOverrideKey != "" {
+		if v, ok := fields[f.TypeOverrideKey]; ok {
+			delete(fields, f.TypeOverrideKey)
+			if s, ok := v.(string); ok && s != "" {
+				typ = s
+			}
+		}
+	}
+	typ = expandDatePattern(typ, entry.Time)
 
-	if timeStampFormat == "" {
-		timeStampFormat = defaultTimestampFormat
+	if f.FlattenFields {
+		flattened := make(logrus.Fields, len(fields))
+		for k, v := range fields {
+			flattenField(flattened, k, v)
+		}
+		fields = flattened
+	}
+
+	if f.MaxFields > 0 && len(fields) > f.MaxFields {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			if !f.isReservedField(k) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		if len(keys) > f.MaxFields {
+			for _, k := range keys[f.MaxFields:] {
+				delete(fields, k)
+			}
+			fields["fields_dropped"] = len(keys) - f.MaxFields
+		}
+	}
+
+	if f.MaxFieldValueLength > 0 {
+		var truncated []string
+		for k, v := range fields {
+			if s, ok := v.(string); ok && len(s) > f.MaxFieldValueLength {
+				fields[k] = truncateWithEllipsis(s, f.MaxFieldValueLength)
+				truncated = append(truncated, k)
+			}
+		}
+		if len(truncated) > 0 {
+			sort.Strings(truncated)
+			fields["truncated_fields"] = truncated
+		}
 	}
 
-	fields["@timestamp"] = entry.Time.Format(timeStampFormat)
+	if f.MaxArrayLength > 0 {
+		capped := make(map[string]int)
+		for k, v := range fields {
+			if rv := reflect.ValueOf(v); isArray(rv) && rv.Len() > f.MaxArrayLength {
+				fields[k] = capArray(rv, f.MaxArrayLength)
+				capped[k] = rv.Len()
+			}
+		}
+		if len(capped) > 0 {
+			fields["capped_fields"] = capped
+		}
+	}
+
+	// set @version and @timestamp fields, user fields named as them, also with prefix, are kept under "fields."
+	for _, k := range []string{"@version", "@timestamp"} {
+		if v, ok := fields[k]; ok {
+			fields["fields."+k] = v
+		}
+	}
+	if f.sendsReserved(ReservedVersion) {
+		fields["@version"] = "1"
+	} else {
+		delete(fields, "@version")
+	}
+
+	if f.sendsReserved(ReservedTimestamp) {
+		fields["@timestamp"] = entry.Time.Format(timeStampFormat)
+	} else {
+		delete(fields, "@timestamp")
+	}
 
 	// set message field
 	v, ok := entry.Data["message"]
 	if ok {
 		fields["fields.message"] = v
 	}
-	fields["message"] = entry.Message
+	message := entry.Message
+	if message == "" && f.MessageFallbackKey != "" {
+		if v, ok := fields[f.MessageFallbackKey]; ok {
+			message = fmt.Sprint(v)
+			delete(fields, f.MessageFallbackKey)
+		}
+	}
+	if message == "" {
+		message = f.EmptyMessagePlaceholder
+	}
+	if (message != "" || !f.OmitEmptyMessage) && !f.isMessageOmitted(entry.Level) && f.sendsReserved(ReservedMessage) {
+		fields["message"] = message
+	} else {
+		delete(fields, "message")
+	}
 
 	// set level field
 	v, ok = entry.Data["level"]
 	if ok {
 		fields["fields.level"] = v
 	}
-	fields["level"] = entry.Level.String()
+	if f.sendsReserved(ReservedLevel) {
+		fields["level"] = entry.Level.String()
+	} else {
+		delete(fields, "level")
+	}
+	if f.RawLevelKey != "" {
+		fields[f.RawLevelKey] = uint32(entry.Level)
+	}
 
 	// set type field
-	if f.Type != "" {
-		v, ok = entry.Data["type"]
+	if typ != "" {
+		key := f.TypeKey
+		if key == "" {
+			key = defaultTypeKey
+		}
+		v, ok = entry.Data[key]
 		if ok {
-			fields["fields.type"] = v
+			fields["fields."+key] = v
+		}
+		if f.sendsReserved(ReservedType) {
+			fields[key] = typ
+		} else {
+			delete(fields, key)
+		}
+	}
+
+	// set service name field
+	if f.ServiceName != "" {
+		key := f.ServiceNameKey
+		if key == "" {
+			key = defaultServiceNameKey
+		}
+		v, ok = entry.Data[key]
+		if ok {
+			fields["fields."+key] = v
+		}
+		fields[key] = f.ServiceName
+	}
+
+	// set caller package field
+	if f.CallerPackageKey != "" && entry.Caller != nil {
+		v, ok = entry.Data[f.CallerPackageKey]
+		if ok {
+			fields["fields."+f.CallerPackageKey] = v
+		}
+		fields[f.CallerPackageKey] = callerPackage(entry.Caller.Function)
+	}
+
+	// move hmac field which is added by the formatter
+	if len(f.HMACKey) > 0 {
+		if v, ok := fields["hmac"]; ok {
+			fields["fields.hmac"] = v
+			delete(fields, "hmac")
+		}
+	}
+
+	// move time field which may be treated as timestamp by some setups
+	if f.RelocateTimeField {
+		if v, ok := fields["time"]; ok {
+			fields["fields.time"] = v
+			delete(fields, "time")
 		}
-		fields["type"] = f.Type
 	}
 
 	serialized, err := json.Marshal(fields)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to marshal fields to JSON, %v", err)
 	}
+	if f.MaxDocumentBytes > 0 && len(serialized) > f.MaxDocumentBytes {
+		if serialized, err = f.prune(fields, serialized); err != nil {
+			return nil, fmt.Errorf("Failed to marshal fields to JSON, %v", err)
+		}
+	}
 	return append(serialized, '\n'), nil
 }
+
+// prune removes the largest fields or truncates the message until serialized fields fit into MaxDocumentBytes.
+// The document is returned over the limit if there is nothing left to prune.
+func (f *LogstashFormatter) prune(fields logrus.Fields, serialized []byte) ([]byte, error) {
+	var pruned []string
+	seen := make(map[string]bool)
+	for len(serialized) > f.MaxDocumentBytes {
+		largest, largestSize := "", 0
+		for k, v := range fields {
+			if unprunableFields[k] || (k == "message" && v == "") {
+				continue
+			}
+			b, _ := json.Marshal(v)
+			if len(b) > largestSize || (len(b) == largestSize && k < largest) {
+				largest, largestSize = k, len(b)
+			}
+		}
+		if largest == "" {
+			break
+		}
+
+		message, isString := fields[largest].(string)
+		if largest == "message" && isString {
+			fields["message"] = truncateString(message, len(message)-(len(serialized)-f.MaxDocumentBytes))
+		} else {
+			delete(fields, largest)
+		}
+		if !seen[largest] {
+			pruned = append(pruned, largest)
+			seen[largest] = true
+		}
+		fields["pruned_fields"] = pruned
+
+		var err error
+		if serialized, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+	}
+
+	return serialized, nil
+}
+
+// truncateString cuts s to at most n bytes without splitting UTF-8 characters.
+// truncateWithEllipsis truncates s to n bytes including ellipsis. It is left out if n is too small for it.
+func truncateWithEllipsis(s string, n int) string {
+	const ellipsis = "…"
+	if n < len(ellipsis) {
+		return truncateString(s, n)
+	}
+
+	return truncateString(s, n-len(ellipsis)) + ellipsis
+}
+
+func truncateString(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if n >= len(s) {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// isReservedField reports whether entry field named k is replaced by a field of the formatter,
+// so it is moved under "fields." or, for MessageFallbackKey, sent as message.
+func (f *LogstashFormatter) isReservedField(k string) bool {
+	typeKey := f.TypeKey
+	if typeKey == "" {
+		typeKey = defaultTypeKey
+	}
+	serviceNameKey := f.ServiceNameKey
+	if serviceNameKey == "" {
+		serviceNameKey = defaultServiceNameKey
+	}
+
+	switch {
+	case k == "@version" || k == "@timestamp" || k == "message" || k == "level" || k == typeKey:
+		return true
+	case f.ServiceName != "" && k == serviceNameKey:
+		return true
+	case f.CallerPackageKey != "" && k == f.CallerPackageKey:
+		return true
+	case len(f.HMACKey) > 0 && k == "hmac":
+		return true
+	case f.RelocateTimeField && k == "time":
+		return true
+	}
+
+	return f.MessageFallbackKey != "" && k == f.MessageFallbackKey
+}
+
+// fastPathReserved are keys which entry fields may collide with when there are no options changing reserved fields.
+var fastPathReserved = map[string]bool{
+	"@version":   true,
+	"@timestamp": true,
+	"message":    true,
+	"level":      true,
+	"type":       true,
+}
+
+// canFormatFast reports whether entry fields can be encoded as they are, without copying them:
+// no options change the fields, no fields have the prefix and none of them collide with reserved ones.
+func (f *LogstashFormatter) canFormatFast(entry *logrus.Entry, prefix string) bool {
+	if f.DurationUnit != 0 || f.FormatTimeFields || f.MessageFallbackKey != "" || f.EmptyMessagePlaceholder != "" ||
+		f.OmitEmptyMessage || len(f.OmitMessageLevels) > 0 || f.RawLevelKey != "" || f.RelocateTimeField ||
+		f.FlattenFields || f.MaxFields > 0 || f.StructuredErrors || f.MaxDocumentBytes > 0 || f.MaxSafeInt > 0 ||
+		f.BytesAsString || f.ReservedKeys != 0 || f.ServiceName != "" || f.CallerPackageKey != "" ||
+		f.MaxFieldValueLength > 0 || f.TypeOverrideKey != "" || len(f.FieldTypes) > 0 || f.DereferencePointers ||
+		f.OmitNilPointers || f.TypeKey != "" || f.FloatPrecision > 0 ||
+		f.MaxArrayLength > 0 {
+		return false
+	}
+
+	for k := range entry.Data {
+		if fastPathReserved[k] || (prefix != "" && strings.HasPrefix(k, prefix)) || (k == "hmac" && len(f.HMACKey) > 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// formatFast encodes entry fields merged with reserved ones in key order, as json.Marshal does with a map.
+func (f *LogstashFormatter) formatFast(entry *logrus.Entry, timeStampFormat string) ([]byte, error) {
+	// Reserved fields in key order.
+	reserved := []struct {
+		key   string
+		value interface{}
+	}{
+		{"@timestamp", entry.Time.Format(timeStampFormat)},
+		{"@version", "1"},
+		{"level", entry.Level.String()},
+		{"message", entry.Message},
+		{"type", expandDatePattern(f.Type, entry.Time)},
+	}
+	if f.Type == "" {
+		reserved = reserved[:len(reserved)-1]
+	}
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	encode := func(key string, value interface{}) error {
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case float32, float64:
+			value = f.replaceNonFinite(v)
+		}
+
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		// Encoder appends newline after each value.
+		if isPlainJSONString(key) {
+			b.WriteByte('"')
+			b.WriteString(key)
+			b.WriteByte('"')
+		} else {
+			if err := enc.Encode(key); err != nil {
+				return err
+			}
+			b.Truncate(b.Len() - 1)
+		}
+		b.WriteByte(':')
+		if err := enc.Encode(value); err != nil {
+			return err
+		}
+		b.Truncate(b.Len() - 1)
+
+		return nil
+	}
+
+	b.WriteByte('{')
+	for len(keys) > 0 || len(reserved) > 0 {
+		var err error
+		if len(reserved) == 0 || (len(keys) > 0 && keys[0] < reserved[0].key) {
+			err = encode(keys[0], entry.Data[keys[0]])
+			keys = keys[1:]
+		} else {
+			err = encode(reserved[0].key, reserved[0].value)
+			reserved = reserved[1:]
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal fields to JSON, %v", err)
+		}
+	}
+	b.WriteString("}\n")
+
+	return b.Bytes(), nil
+}
+
+// isPlainJSONString reports whether s is encoded to JSON as is, i.e. it doesn't need escaping.
+func isPlainJSONString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= utf8.RuneSelf || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// replaceNonFinite returns replacement of NaN or infinite float value or the value itself.
+func (f *LogstashFormatter) replaceNonFinite(value interface{}) interface{} {
+	var v float64
+	switch value := value.(type) {
+	case float32:
+		v = float64(value)
+	case float64:
+		v = value
+	}
+	if (!math.IsNaN(v) && !math.IsInf(v, 0)) || f.NonFiniteFloats == NonFiniteAsError {
+		return value
+	}
+
+	if f.NonFiniteFloats == NonFiniteAsString {
+		switch {
+		case math.IsNaN(v):
+			return "NaN"
+		case v > 0:
+			return "+Inf"
+		default:
+			return "-Inf"
+		}
+	}
+
+	return nil
+}
+
+// isArray reports whether v is a slice or an array other than bytes, which are sent as strings.
+func isArray(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		return v.Type().Elem().Kind() != reflect.Uint8
+	}
+
+	return false
+}
+
+// capArray returns slice with the first n elements of slice or array v.
+func capArray(v reflect.Value, n int) interface{} {
+	capped := reflect.MakeSlice(reflect.SliceOf(v.Type().Elem()), n, n)
+	reflect.Copy(capped, v)
+
+	return capped.Interface()
+}
+
+// roundFloat returns float value formatted with FloatPrecision significant digits as a JSON number.
+// Other values are returned as is.
+func (f *LogstashFormatter) roundFloat(value interface{}) interface{} {
+	if f.FloatPrecision <= 0 {
+		return value
+	}
+
+	switch v := value.(type) {
+	case float32:
+		if !math.IsNaN(float64(v)) && !math.IsInf(float64(v), 0) {
+			return json.Number(strconv.FormatFloat(float64(v), 'g', f.FloatPrecision, 32))
+		}
+	case float64:
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			return json.Number(strconv.FormatFloat(v, 'g', f.FloatPrecision, 64))
+		}
+	}
+
+	return value
+}
+
+// formatLargeInt returns integer value as a string if it is above MaxSafeInt.
+func (f *LogstashFormatter) formatLargeInt(value interface{}) (string, bool) {
+	if f.MaxSafeInt == 0 {
+		return "", false
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := rv.Int()
+		abs := uint64(i)
+		if i < 0 {
+			abs = uint64(-(i + 1)) + 1
+		}
+		return strconv.FormatInt(i, 10), abs > f.MaxSafeInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		return strconv.FormatUint(u, 10), u > f.MaxSafeInt
+	}
+
+	return "", false
+}
+
+// dereference returns value pointed to by v if DereferencePointers is set and reports whether v is a nil pointer.
+// Nil pointers are returned as nil, so they aren't called as errors.
+func (f *LogstashFormatter) dereference(v interface{}) (interface{}, bool) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, true
+		}
+		if !f.DereferencePointers {
+			return v, false
+		}
+		if !implementsSameInterfaces(rv.Interface(), rv.Elem().Interface()) {
+			// Methods with pointer receiver would be lost.
+			return rv.Interface(), false
+		}
+		rv = rv.Elem()
+	}
+
+	if !rv.IsValid() {
+		return v, false
+	}
+
+	return rv.Interface(), false
+}
+
+// implementsSameInterfaces reports whether value implements error and json.Marshaler if pointer does.
+func implementsSameInterfaces(pointer, value interface{}) bool {
+	_, pointerIsError := pointer.(error)
+	_, valueIsError := value.(error)
+	_, pointerIsMarshaler := pointer.(json.Marshaler)
+	_, valueIsMarshaler := value.(json.Marshaler)
+
+	return pointerIsError == valueIsError && pointerIsMarshaler == valueIsMarshaler
+}
+
+// datePatternLayouts replaces Joda-Time tokens of logstash date patterns with Go layout.
+var datePatternLayouts = strings.NewReplacer(
+	"YYYY", "2006", "yyyy", "2006", "YY", "06", "yy", "06",
+	"MM", "01", "dd", "02", "HH", "15", "mm", "04", "ss", "05",
+)
+
+// expandDatePattern replaces date patterns like %{+YYYY.MM.dd} in s with UTC time t formatted accordingly.
+func expandDatePattern(s string, t time.Time) string {
+	for {
+		start := strings.Index(s, "%{+")
+		if start < 0 {
+			return s
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return s
+		}
+		end += start
+
+		layout := datePatternLayouts.Replace(s[start+3 : end])
+		s = s[:start] + t.UTC().Format(layout) + s[end+1:]
+	}
+}
+
+// convertField converts value to typ. Value is returned as is if it can't be converted.
+func convertField(value interface{}, typ string) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	s, isString := value.(string)
+	if !isString {
+		// Values are converted as they would be serialized, e.g. time in RFC3339 and maps as JSON objects.
+		b, err := json.Marshal(value)
+		switch {
+		case err != nil:
+			s = fmt.Sprint(value)
+		case json.Unmarshal(b, &s) != nil:
+			s = string(b)
+		}
+	}
+
+	switch typ {
+	case "string":
+		return s, nil
+	case "int":
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return int64(f), nil
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+	case "bool":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %q", typ)
+	}
+
+	return value, nil
+}
+
+func (f *LogstashFormatter) sendsReserved(key ReservedKey) bool {
+	return f.ReservedKeys == 0 || f.ReservedKeys&key != 0
+}
+
+func (f *LogstashFormatter) isMessageOmitted(level logrus.Level) bool {
+	for _, l := range f.OmitMessageLevels {
+		if l == level {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decomposeError returns error message and type along with the ones of the errors it wraps.
+func decomposeError(err error) map[string]interface{} {
+	decomposed := map[string]interface{}{
+		"message": err.Error(),
+		"type":    reflect.TypeOf(err).String(),
+	}
+
+	var chain []map[string]interface{}
+	for {
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		if err = u.Unwrap(); err == nil {
+			break
+		}
+		chain = append(chain, map[string]interface{}{
+			"message": err.Error(),
+			"type":    reflect.TypeOf(err).String(),
+		})
+	}
+	if len(chain) > 0 {
+		decomposed["chain"] = chain
+	}
+
+	return decomposed
+}
+
+// callerPackage returns package path of the function, e.g. "github.com/sirupsen/logrus"
+// for "github.com/sirupsen/logrus.(*Entry).Info".
+func callerPackage(function string) string {
+	slash := strings.LastIndex(function, "/")
+	pkg := function
+	if dot := strings.Index(function[slash+1:], "."); dot >= 0 {
+		pkg = function[:slash+1+dot]
+	}
+
+	// Dots in the last element of package path are escaped in function names.
+	return strings.Replace(pkg, "%2e", ".", -1)
+}
+
+// flattenField adds value to fields under key, or its nested values under dotted keys if it is an object.
+func flattenField(fields logrus.Fields, key string, value interface{}) {
+	var nested map[string]interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		nested = v
+	case logrus.Fields:
+		nested = v
+	default:
+		rv := reflect.Indirect(reflect.ValueOf(value))
+		if rv.Kind() == reflect.Map || rv.Kind() == reflect.Struct {
+			nested = toJSONObject(value)
+		}
+	}
+
+	if len(nested) == 0 {
+		fields[key] = value
+		return
+	}
+
+	for k, v := range nested {
+		flattenField(fields, key+"."+k, v)
+	}
+}
+
+// toJSONObject returns value as it would be seen by JSON consumers, or nil if it isn't a JSON object.
+func toJSONObject(value interface{}) map[string]interface{} {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+
+	var object map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&object); err != nil {
+		return nil
+	}
+
+	return object
+}
+
+// trimPrefix removes prefix from the field key. It returns false if the entry also has the field
+// without prefix: such field takes precedence, e.g. "id" field wins over "_id" one with "_" prefix.
+// Reserved @timestamp and @version keys are kept as is, e.g. with "@" prefix.
+func trimPrefix(data logrus.Fields, key, prefix string) (string, bool) {
+	if prefix == "" || !strings.HasPrefix(key, prefix) || key == "@timestamp" || key == "@version" {
+		return key, true
+	}
+
+	key = strings.TrimPrefix(key, prefix)
+	_, inMap := data[key]
+
+	return key, !inMap
+}
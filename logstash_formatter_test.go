@@ -2,10 +2,19 @@ package logrustash
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -70,3 +79,1072 @@ func TestLogstashFormatter(t *testing.T) {
 		t.Errorf("expected bool to be '%v' but got '%v'", true, data["bool"])
 	}
 }
+
+func TestLogstashFormatterDurationAndTimeFields(t *testing.T) {
+	fTime := time.Date(2009, time.November, 10, 3, 4, 0, 0, time.UTC)
+	entry := &logrus.Entry{
+		Message: "msg",
+		Data: logrus.Fields{
+			"latency": 1500 * time.Microsecond,
+			"started": fTime,
+		},
+	}
+
+	tt := []struct {
+		formatter LogstashFormatter
+		latency   string
+		started   string
+	}{
+		{LogstashFormatter{}, "1500000", `"2009-11-10T03:04:00Z"`},
+		{LogstashFormatter{DurationUnit: time.Millisecond, TimestampFormat: time.Kitchen}, "1.5", `"2009-11-10T03:04:00Z"`},
+		{LogstashFormatter{DurationUnit: time.Second, TimestampFormat: time.Kitchen, FormatTimeFields: true}, "0.0015", `"3:04AM"`},
+	}
+
+	for _, te := range tt {
+		b, err := te.formatter.Format(entry)
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]json.RawMessage
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		if string(data["latency"]) != te.latency {
+			t.Errorf("expected latency to be '%s' but got '%s'", te.latency, data["latency"])
+		}
+		if string(data["started"]) != te.started {
+			t.Errorf("expected started to be '%s' but got '%s'", te.started, data["started"])
+		}
+	}
+}
+
+func TestLogstashFormatterEmptyMessage(t *testing.T) {
+	tt := []struct {
+		formatter LogstashFormatter
+		data      logrus.Fields
+		message   interface{}
+		present   bool
+	}{
+		{LogstashFormatter{}, logrus.Fields{}, "", true},
+		{LogstashFormatter{OmitEmptyMessage: true}, logrus.Fields{}, nil, false},
+		{LogstashFormatter{OmitEmptyMessage: true}, logrus.Fields{"message": "def"}, nil, false},
+		{LogstashFormatter{EmptyMessagePlaceholder: "<empty>", OmitEmptyMessage: true}, logrus.Fields{}, "<empty>", true},
+		{LogstashFormatter{MessageFallbackKey: "msg", EmptyMessagePlaceholder: "<empty>"}, logrus.Fields{"msg": "from field"}, "from field", true},
+		{LogstashFormatter{MessageFallbackKey: "msg", EmptyMessagePlaceholder: "<empty>"}, logrus.Fields{}, "<empty>", true},
+	}
+
+	for _, te := range tt {
+		b, err := te.formatter.Format(&logrus.Entry{Data: te.data})
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		message, ok := data["message"]
+		if ok != te.present {
+			t.Errorf("expected message presence to be %v but got %v in '%s'", te.present, ok, b)
+		}
+		if message != te.message {
+			t.Errorf("expected message to be '%v' but got '%v'", te.message, message)
+		}
+		if _, ok := data["msg"]; ok {
+			t.Errorf("expected msg field to be moved to message but got '%s'", b)
+		}
+	}
+}
+
+func TestLogstashFormatterMaxFields(t *testing.T) {
+	lf := LogstashFormatter{Type: "abc", MaxFields: 3}
+
+	fields := logrus.Fields{}
+	for i := 0; i < 100; i++ {
+		fields[fmt.Sprintf("field%02d", i)] = i
+	}
+
+	b, err := lf.Format(&logrus.Entry{Message: "msg", Data: fields})
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"@timestamp", "@version", "field00", "field01", "field02", "fields_dropped", "level", "message", "type"}
+	if len(data) != len(expected) {
+		t.Errorf("expected %d fields but got %d: '%s'", len(expected), len(data), b)
+	}
+	for _, key := range expected {
+		if _, ok := data[key]; !ok {
+			t.Errorf("expected data to have '%s'", key)
+		}
+	}
+	if data["fields_dropped"] != float64(97) {
+		t.Errorf("expected fields_dropped to be '%v' but got '%v'", 97, data["fields_dropped"])
+	}
+
+	// Field named message is moved to fields.message and isn't counted regardless of the other fields.
+	for _, n := range []int{2, 3, 10} {
+		fields := logrus.Fields{"message": "user message"}
+		for i := 0; i < n; i++ {
+			fields[fmt.Sprintf("field%02d", i)] = i
+		}
+
+		b, err := lf.Format(&logrus.Entry{Message: "msg", Data: fields})
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data["message"] != "msg" || data["fields.message"] != "user message" {
+			t.Errorf("expected message field to be moved to fields.message with %d other fields but got '%s'", n, b)
+		}
+		if _, ok := data["field02"]; ok != (n > 2) {
+			t.Errorf("expected %d fields to be kept besides message but got '%s'", lf.MaxFields, b)
+		}
+		if dropped, ok := data["fields_dropped"]; n > lf.MaxFields && dropped != float64(n-lf.MaxFields) || n <= lf.MaxFields && ok {
+			t.Errorf("expected only other fields to be counted as dropped with %d of them but got '%s'", n, b)
+		}
+	}
+}
+
+func TestLogstashFormatterOmitMessageLevels(t *testing.T) {
+	lf := LogstashFormatter{OmitMessageLevels: []logrus.Level{logrus.DebugLevel, logrus.InfoLevel}}
+
+	tt := []struct {
+		level   logrus.Level
+		present bool
+	}{
+		{logrus.ErrorLevel, true},
+		{logrus.WarnLevel, true},
+		{logrus.InfoLevel, false},
+		{logrus.DebugLevel, false},
+	}
+
+	for _, te := range tt {
+		b, err := lf.Format(&logrus.Entry{Message: "secret", Level: te.level, Data: logrus.Fields{"id": 1}})
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := data["message"]; ok != te.present {
+			t.Errorf("expected message presence for %s to be %v but got '%s'", te.level, te.present, b)
+		}
+		if data["id"] != float64(1) {
+			t.Errorf("expected id to be sent for %s but got '%s'", te.level, b)
+		}
+	}
+}
+
+func TestLogstashFormatterFlattenFields(t *testing.T) {
+	type request struct {
+		Method string `json:"method"`
+		Size   int    `json:"size"`
+	}
+
+	entry := &logrus.Entry{
+		Message: "msg",
+		Data: logrus.Fields{
+			"a":       map[string]interface{}{"b": map[string]interface{}{"c": 1}, "d": "e"},
+			"request": &request{Method: "GET", Size: 10},
+			"labels":  map[string]string{"team": "core"},
+			"time":    time.Date(2009, time.November, 10, 3, 4, 0, 0, time.UTC),
+			"empty":   map[string]interface{}{},
+		},
+	}
+
+	for _, flatten := range []bool{false, true} {
+		lf := LogstashFormatter{FlattenFields: flatten}
+		b, err := lf.Format(entry)
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]interface{}{
+			"a.b.c":          float64(1),
+			"a.d":            "e",
+			"request.method": "GET",
+			"request.size":   float64(10),
+			"labels.team":    "core",
+			"time":           "2009-11-10T03:04:00Z",
+			"empty":          map[string]interface{}{},
+		}
+		for key, value := range expected {
+			actual, ok := data[key]
+			if ok != flatten && key != "time" && key != "empty" {
+				t.Errorf("expected %s presence to be %v but got '%s'", key, flatten, b)
+			}
+			if ok && !reflect.DeepEqual(value, actual) {
+				t.Errorf("expected %s to be '%v' but got '%v'", key, value, actual)
+			}
+		}
+		if _, ok := data["a"]; ok == flatten {
+			t.Errorf("expected nested a presence to be %v but got '%s'", !flatten, b)
+		}
+	}
+}
+
+func TestLogstashFormatterRawLevel(t *testing.T) {
+	lf := LogstashFormatter{RawLevelKey: "level_raw"}
+
+	for _, level := range []logrus.Level{logrus.PanicLevel, logrus.ErrorLevel, logrus.DebugLevel} {
+		b, err := lf.Format(&logrus.Entry{Message: "msg", Level: level})
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data struct {
+			Level    string `json:"level"`
+			LevelRaw uint32 `json:"level_raw"`
+		}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		if logrus.Level(data.LevelRaw) != level || data.Level != level.String() {
+			t.Errorf("expected level '%s' (%d) but got '%s' (%d)", level, level, data.Level, data.LevelRaw)
+		}
+	}
+}
+
+func TestLogstashFormatterAsLogrusFormatter(t *testing.T) {
+	out := bytes.NewBufferString("")
+	log := logrus.New()
+	log.Out = out
+	log.Formatter = &LogstashFormatter{
+		Type:              "standalone",
+		TimestampFormat:   time.Kitchen,
+		DurationUnit:      time.Millisecond,
+		FlattenFields:     true,
+		RawLevelKey:       "level_raw",
+		OmitMessageLevels: []logrus.Level{logrus.DebugLevel},
+	}
+	log.Level = logrus.DebugLevel
+
+	log.WithFields(logrus.Fields{
+		"latency": 2 * time.Millisecond,
+		"user":    map[string]interface{}{"id": 7},
+	}).Warn("visible")
+	log.Debug("hidden")
+
+	dec := json.NewDecoder(out)
+	var warn, debug map[string]interface{}
+	if err := dec.Decode(&warn); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&debug); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"type":      "standalone",
+		"message":   "visible",
+		"latency":   float64(2),
+		"user.id":   float64(7),
+		"level_raw": float64(logrus.WarnLevel),
+	}
+	for key, value := range expected {
+		if warn[key] != value {
+			t.Errorf("expected %s to be '%v' but got '%v'", key, value, warn[key])
+		}
+	}
+	if _, err := time.Parse(time.Kitchen, warn["@timestamp"].(string)); err != nil {
+		t.Errorf("expected @timestamp in kitchen format but got '%v'", warn["@timestamp"])
+	}
+	if _, ok := debug["message"]; ok {
+		t.Errorf("expected debug message to be omitted but got '%v'", debug)
+	}
+}
+
+func TestLogstashFormatterTimeField(t *testing.T) {
+	entry := &logrus.Entry{Message: "msg", Data: logrus.Fields{"time": "yesterday"}}
+
+	tt := []struct {
+		formatter LogstashFormatter
+		key       string
+		missing   string
+	}{
+		{LogstashFormatter{}, "time", "fields.time"},
+		{LogstashFormatter{RelocateTimeField: true}, "fields.time", "time"},
+	}
+
+	for _, te := range tt {
+		b, err := te.formatter.Format(entry)
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data[te.key] != "yesterday" {
+			t.Errorf("expected %s to be '%s' but got '%v'", te.key, "yesterday", data[te.key])
+		}
+		if _, ok := data[te.missing]; ok {
+			t.Errorf("expected %s to be absent but got '%s'", te.missing, b)
+		}
+		if data["@timestamp"] == "" {
+			t.Error("expected @timestamp to be not empty")
+		}
+	}
+}
+
+type queryError struct {
+	query string
+	err   error
+}
+
+func (e *queryError) Error() string { return e.query + ": " + e.err.Error() }
+func (e *queryError) Unwrap() error { return e.err }
+
+func TestLogstashFormatterStructuredErrors(t *testing.T) {
+	lf := LogstashFormatter{StructuredErrors: true}
+	cause := &url.Error{Op: "Get", URL: "http://db", Err: fmt.Errorf("refused")}
+	entry := &logrus.Entry{Message: "msg", Data: logrus.Fields{"error": &queryError{query: "select", err: cause}}}
+
+	b, err := lf.Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	var data struct {
+		Error struct {
+			Message string
+			Type    string
+			Chain   []struct {
+				Message string
+				Type    string
+			}
+		}
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	if data.Error.Type != "*logrustash.queryError" || data.Error.Message != "select: "+cause.Error() {
+		t.Errorf("expected error type and message of queryError but got '%s'", b)
+	}
+	if len(data.Error.Chain) != 2 {
+		t.Fatalf("expected error chain to have 2 errors but got '%s'", b)
+	}
+	if data.Error.Chain[0].Type != "*url.Error" || data.Error.Chain[0].Message != cause.Error() {
+		t.Errorf("expected first wrapped error to be url.Error but got '%v'", data.Error.Chain[0])
+	}
+	if data.Error.Chain[1].Type != "*errors.errorString" || data.Error.Chain[1].Message != "refused" {
+		t.Errorf("expected second wrapped error to be 'refused' but got '%v'", data.Error.Chain[1])
+	}
+}
+
+func TestLogstashFormatterServiceName(t *testing.T) {
+	entry := &logrus.Entry{Message: "msg", Data: logrus.Fields{"source": "user"}}
+
+	tt := []struct {
+		formatter LogstashFormatter
+		key       string
+	}{
+		{LogstashFormatter{Type: "logs", ServiceName: "shop"}, "service.name"},
+		{LogstashFormatter{Type: "logs", ServiceName: "shop", ServiceNameKey: "source"}, "source"},
+	}
+
+	for _, te := range tt {
+		b, err := te.formatter.Format(entry)
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data["type"] != "logs" {
+			t.Errorf("expected type to be '%s' but got '%v'", "logs", data["type"])
+		}
+		if data[te.key] != "shop" {
+			t.Errorf("expected %s to be '%s' but got '%v'", te.key, "shop", data[te.key])
+		}
+	}
+
+	b, _ := (&LogstashFormatter{ServiceName: "shop", ServiceNameKey: "source"}).Format(entry)
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["fields.source"] != "user" {
+		t.Errorf("expected entry source field to be moved to fields.source but got '%s'", b)
+	}
+	if _, ok := data["type"]; ok {
+		t.Errorf("expected type to be absent but got '%s'", b)
+	}
+}
+
+func TestLogstashFormatterTypeDatePattern(t *testing.T) {
+	entry := &logrus.Entry{
+		Message: "msg",
+		Time:    time.Date(2024, 6, 1, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*60*60)),
+		Data:    logrus.Fields{"stream": "audit"},
+	}
+
+	for _, te := range []struct {
+		formatter LogstashFormatter
+		expected  string
+	}{
+		{LogstashFormatter{Type: "logs-%{+YYYY.MM.dd}"}, "logs-2024.06.02"},
+		{LogstashFormatter{Type: "logs-%{+yyyy.MM}-%{+HH}"}, "logs-2024.06-01"},
+		{LogstashFormatter{Type: "logs", TypeOverrideKey: "stream"}, "audit"},
+		{LogstashFormatter{Type: "logs-%{+YYYY"}, "logs-%{+YYYY"},
+		{LogstashFormatter{Type: "logs-%{+YYYY.MM.dd}", FlattenFields: true}, "logs-2024.06.02"},
+	} {
+		b, err := te.formatter.Format(entry)
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data["type"] != te.expected {
+			t.Errorf("expected type '%s' to be expanded to '%s' but got '%v'", te.formatter.Type, te.expected, data["type"])
+		}
+	}
+}
+
+func TestLogstashFormatterTypeKey(t *testing.T) {
+	entry := &logrus.Entry{Message: "msg", Data: logrus.Fields{"type": "user", "service.type": "other"}}
+
+	b, err := (&LogstashFormatter{Type: "shop", TypeKey: "service.type"}).Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["service.type"] != "shop" {
+		t.Errorf("expected service.type to be '%s' but got '%v'", "shop", data["service.type"])
+	}
+	if data["fields.service.type"] != "other" {
+		t.Errorf("expected entry service.type field to be moved to fields.service.type but got '%s'", b)
+	}
+	if data["type"] != "user" {
+		t.Errorf("expected entry type field to be sent as is but got '%s'", b)
+	}
+
+	b, _ = (&LogstashFormatter{Type: "shop", TypeKey: "service.type", ReservedKeys: AllReservedKeys &^ ReservedType}).Format(entry)
+	data = nil
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data["service.type"]; ok || data["fields.service.type"] != "other" {
+		t.Errorf("expected type to be omitted but got '%s'", b)
+	}
+}
+
+func TestLogstashFormatterFloatPrecision(t *testing.T) {
+	entry := &logrus.Entry{Message: "msg", Data: logrus.Fields{
+		"sum":   0.1 + 0.2,
+		"ratio": float32(1) / 3,
+		"big":   123456789.0,
+		"count": 3,
+	}}
+
+	b, err := (&LogstashFormatter{FloatPrecision: 6}).Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	for _, expected := range []string{`"sum":0.3}`, `"ratio":0.333333,`, `"big":1.23457e+08,`, `"count":3,`} {
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("expected %s in document but got '%s'", expected, b)
+		}
+	}
+}
+
+func TestLogstashFormatterMaxDocumentBytes(t *testing.T) {
+	lf := LogstashFormatter{Type: "abc", MaxDocumentBytes: 300}
+	entry := &logrus.Entry{
+		Message: strings.Repeat("m", 200),
+		Data: logrus.Fields{
+			"big":    strings.Repeat("b", 500),
+			"bigger": strings.Repeat("c", 600),
+			"id":     42,
+		},
+	}
+
+	b, err := lf.Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+	if len(b)-1 > lf.MaxDocumentBytes {
+		t.Errorf("expected document to fit into %d bytes but got %d: '%s'", lf.MaxDocumentBytes, len(b)-1, b)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{"bigger", "big", "message"}
+	if !reflect.DeepEqual(data["pruned_fields"], expected) {
+		t.Errorf("expected pruned_fields to be %v but got '%v'", expected, data["pruned_fields"])
+	}
+	if data["id"] != float64(42) || data["type"] != "abc" {
+		t.Errorf("expected small and reserved fields to be kept but got '%s'", b)
+	}
+	if message, _ := data["message"].(string); message == "" || !strings.HasPrefix(entry.Message, message) {
+		t.Errorf("expected message to be truncated but got '%v'", data["message"])
+	}
+}
+
+func TestLogstashFormatterMaxFieldValueLength(t *testing.T) {
+	lf := LogstashFormatter{Type: "abc", MaxFieldValueLength: 10}
+	entry := &logrus.Entry{
+		Message: strings.Repeat("m", 20),
+		Data: logrus.Fields{
+			"body":  strings.Repeat("b", 500),
+			"name":  "日本語日本語",
+			"short": "ok",
+			"id":    12345678901234,
+		},
+	}
+
+	b, err := lf.Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	// Ellipsis takes 3 bytes of the limit.
+	if data["body"] != strings.Repeat("b", 7)+"…" {
+		t.Errorf("expected body to be truncated but got '%v'", data["body"])
+	}
+	if data["name"] != "日本…" {
+		t.Errorf("expected name to be truncated without splitting characters but got '%v'", data["name"])
+	}
+	if data["short"] != "ok" || data["id"] != float64(12345678901234) || data["message"] != entry.Message {
+		t.Errorf("expected short fields and message to be kept but got '%s'", b)
+	}
+	expected := []interface{}{"body", "name"}
+	if !reflect.DeepEqual(data["truncated_fields"], expected) {
+		t.Errorf("expected truncated_fields to be %v but got '%v'", expected, data["truncated_fields"])
+	}
+
+	// Ellipsis is left out if it doesn't fit.
+	lf.MaxFieldValueLength = 2
+	b, err = lf.Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["body"] != "bb" || data["name"] != "" {
+		t.Errorf("expected fields to be truncated without ellipsis but got '%v' and '%v'", data["body"], data["name"])
+	}
+}
+
+func TestLogstashFormatterMaxArrayLength(t *testing.T) {
+	type item struct {
+		ID int `json:"id"`
+	}
+	items := make([]item, 100)
+	for i := range items {
+		items[i].ID = i
+	}
+	entry := &logrus.Entry{Message: "msg", Data: logrus.Fields{
+		"items": items,
+		"codes": [4]string{"a", "b", "c", "d"},
+		"tags":  []string{"x", "y"},
+		"raw":   []byte("0123456789"),
+	}}
+
+	b, err := (&LogstashFormatter{MaxArrayLength: 3}).Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	expectedItems := []interface{}{
+		map[string]interface{}{"id": 0.0}, map[string]interface{}{"id": 1.0}, map[string]interface{}{"id": 2.0},
+	}
+	if !reflect.DeepEqual(data["items"], expectedItems) {
+		t.Errorf("expected items to be capped to %v but got '%v'", expectedItems, data["items"])
+	}
+	if !reflect.DeepEqual(data["codes"], []interface{}{"a", "b", "c"}) {
+		t.Errorf("expected array to be capped but got '%v'", data["codes"])
+	}
+	if !reflect.DeepEqual(data["tags"], []interface{}{"x", "y"}) || data["raw"] != "MDEyMzQ1Njc4OQ==" {
+		t.Errorf("expected short slices and bytes to be kept but got '%s'", b)
+	}
+	expected := map[string]interface{}{"items": 100.0, "codes": 4.0}
+	if !reflect.DeepEqual(data["capped_fields"], expected) {
+		t.Errorf("expected capped_fields to be %v but got '%v'", expected, data["capped_fields"])
+	}
+}
+
+func TestLogstashFormatterFieldTypes(t *testing.T) {
+	lf := LogstashFormatter{Type: "abc", FieldTypes: map[string]string{
+		"status":  "string",
+		"query":   "string",
+		"latency": "float",
+		"count":   "int",
+		"cached":  "bool",
+		"user":    "int",
+	}}
+
+	b, err := lf.Format(&logrus.Entry{Message: "msg", Data: logrus.Fields{
+		"status":  404,
+		"query":   map[string]int{"page": 2},
+		"latency": "1.5",
+		"count":   "12",
+		"cached":  "true",
+		"user":    "alice",
+	}})
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	for _, expected := range []string{`"status":"404"`, `"query":"{\"page\":2}"`, `"latency":1.5`, `"count":12`, `"cached":true`, `"user":"alice"`} {
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("expected document to contain '%s' but got '%s'", expected, b)
+		}
+	}
+
+	lf.FieldTypes = map[string]string{"status": "keyword"}
+	if _, err := lf.Format(&logrus.Entry{Message: "msg", Data: logrus.Fields{"status": 404}}); err == nil {
+		t.Error("expected format to return error for unknown type")
+	}
+}
+
+func TestLogstashFormatterPointers(t *testing.T) {
+	name := "alice"
+	count := 3
+	at := time.Date(2020, 1, 2, 3, 4, 5, 123, time.UTC)
+	var missing *string
+	fields := logrus.Fields{"name": &name, "count": &count, "at": &at, "missing": missing}
+
+	tt := []struct {
+		lf       LogstashFormatter
+		expected map[string]interface{}
+	}{
+		{
+			LogstashFormatter{DereferencePointers: true, FormatTimeFields: true, FieldTypes: map[string]string{"count": "string"}},
+			map[string]interface{}{"name": "alice", "count": "3", "at": "2020-01-02T03:04:05Z", "missing": nil},
+		},
+		{
+			LogstashFormatter{DereferencePointers: true, OmitNilPointers: true},
+			map[string]interface{}{"name": "alice", "count": float64(3), "at": "2020-01-02T03:04:05.000000123Z"},
+		},
+		{
+			// Pointers are sent as is without DereferencePointers, so FormatTimeFields doesn't apply.
+			LogstashFormatter{OmitNilPointers: true, FormatTimeFields: true},
+			map[string]interface{}{"name": "alice", "count": float64(3), "at": "2020-01-02T03:04:05.000000123Z"},
+		},
+	}
+
+	for _, te := range tt {
+		b, err := te.lf.Format(&logrus.Entry{Message: "msg", Data: fields})
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"@timestamp", "@version", "level", "message"} {
+			delete(data, k)
+		}
+		if !reflect.DeepEqual(data, te.expected) {
+			t.Errorf("expected fields to be %v but got %v", te.expected, data)
+		}
+	}
+}
+
+func TestLogstashFormatterMaxSafeInt(t *testing.T) {
+	lf := LogstashFormatter{MaxSafeInt: 1<<53 - 1}
+	entry := &logrus.Entry{
+		Message: "msg",
+		Data: logrus.Fields{
+			"id":       int64(9223372036854775806),
+			"negative": int64(-9223372036854775808),
+			"unsigned": uint64(18446744073709551615),
+			"small":    42,
+		},
+	}
+
+	b, err := lf.Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"id":       "9223372036854775806",
+		"negative": "-9223372036854775808",
+		"unsigned": "18446744073709551615",
+		"small":    float64(42),
+	}
+	for k, v := range expected {
+		if data[k] != v {
+			t.Errorf("expected %s to be '%v' (%T) but got '%v' (%T)", k, v, v, data[k], data[k])
+		}
+	}
+}
+
+func TestLogstashFormatterBytesAsString(t *testing.T) {
+	entry := &logrus.Entry{Message: "msg", Data: logrus.Fields{"body": []byte("héllo"), "binary": []byte{0xff, 0xfe}}}
+
+	tt := []struct {
+		formatter LogstashFormatter
+		body      string
+	}{
+		{LogstashFormatter{}, "aMOpbGxv"},
+		{LogstashFormatter{BytesAsString: true}, "héllo"},
+	}
+
+	for _, te := range tt {
+		b, err := te.formatter.Format(entry)
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data["body"] != te.body {
+			t.Errorf("expected body to be '%s' but got '%v'", te.body, data["body"])
+		}
+		if data["binary"] != "//4=" {
+			t.Errorf("expected invalid UTF-8 to be sent in base64 but got '%v'", data["binary"])
+		}
+	}
+}
+
+func TestLogstashFormatterReservedKeys(t *testing.T) {
+	lf := LogstashFormatter{Type: "abc", ReservedKeys: ReservedTimestamp | ReservedMessage}
+	entry := &logrus.Entry{Message: "msg", Level: logrus.InfoLevel, Data: logrus.Fields{"type": "user", "id": 1}}
+
+	b, err := lf.Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	expected := []string{"@timestamp", "fields.type", "id", "message"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys to be %v but got %v", expected, keys)
+	}
+}
+
+func benchmarkEntry(fields int) *logrus.Entry {
+	entry := &logrus.Entry{Message: "hello", Level: logrus.InfoLevel, Time: time.Now(), Data: logrus.Fields{}}
+	for i := 0; i < fields; i++ {
+		entry.Data[fmt.Sprintf("field%d", i)] = i
+	}
+	entry.Data["err"] = fmt.Errorf("failed")
+
+	return entry
+}
+
+func benchmarkFormat(b *testing.B, fields int, prefix string) {
+	lf := LogstashFormatter{Type: "abc"}
+	entry := benchmarkEntry(fields)
+	if prefix != "" {
+		entry.Data[prefix+"hook_only"] = "value"
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := lf.FormatWithPrefix(entry, prefix); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Fields with prefix are formatted without the fast path. Before it was added:
+//
+//	BenchmarkFormatSmall	5839 ns/op	1544 B/op	 36 allocs/op
+//	BenchmarkFormatLarge	35184 ns/op	7176 B/op	181 allocs/op
+//	BenchmarkFire       	5339 ns/op	1672 B/op	 30 allocs/op
+//
+// After:
+//
+//	BenchmarkFormatSmall	3094 ns/op	 784 B/op	 20 allocs/op
+//	BenchmarkFormatLarge	21960 ns/op	3528 B/op	 69 allocs/op
+//	BenchmarkFire       	3374 ns/op	1335 B/op	 20 allocs/op
+func BenchmarkFormatSmall(b *testing.B)           { benchmarkFormat(b, 3, "") }
+func BenchmarkFormatLarge(b *testing.B)           { benchmarkFormat(b, 50, "") }
+func BenchmarkFormatWithPrefixSmall(b *testing.B) { benchmarkFormat(b, 3, "_") }
+func BenchmarkFormatWithPrefixLarge(b *testing.B) { benchmarkFormat(b, 50, "_") }
+
+func TestLogstashFormatterFastPath(t *testing.T) {
+	lf := LogstashFormatter{Type: "abc", TimestampFormat: time.RFC3339Nano}
+	entries := []*logrus.Entry{
+		{Message: "msg", Time: time.Now(), Data: logrus.Fields{}},
+		{Message: "<html> & \"quotes\"\n", Level: logrus.ErrorLevel, Data: logrus.Fields{
+			"err":       fmt.Errorf("failed <here>"),
+			"duration":  time.Second,
+			"time":      time.Unix(1500000000, 5),
+			"bytes":     []byte("raw"),
+			"nil":       nil,
+			"float":     1.5,
+			"map":       map[string]interface{}{"b": 1, "a": []int{1, 2}},
+			"ключ":      "значение",
+			"a<b":       "escaped key",
+			"fields.id": 1,
+			"@tag":      "before reserved",
+			"zzz":       "after reserved",
+		}},
+	}
+
+	for _, entry := range entries {
+		if !lf.canFormatFast(entry, "") {
+			t.Fatalf("expected entry to be formatted with fast path: %v", entry.Data)
+		}
+
+		fast, err := lf.formatFast(entry, lf.TimestampFormat)
+		if err != nil {
+			t.Fatalf("expected fast path to not return error: %s", err)
+		}
+		general, err := lf.format(entry, "", lf.TimestampFormat)
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+		if !bytes.Equal(fast, general) {
+			t.Errorf("expected fast path output to be '%s' but got '%s'", general, fast)
+		}
+	}
+
+	for _, entry := range []*logrus.Entry{
+		{Data: logrus.Fields{"message": "collides"}},
+		{Data: logrus.Fields{"_hook": "prefixed"}},
+	} {
+		if lf.canFormatFast(entry, "_") {
+			t.Errorf("expected entry to be formatted without fast path: %v", entry.Data)
+		}
+	}
+	if (&LogstashFormatter{FlattenFields: true}).canFormatFast(entries[0], "") {
+		t.Error("expected options to disable fast path")
+	}
+}
+
+func TestLogstashFormatterTimestampField(t *testing.T) {
+	lf := LogstashFormatter{}
+	entry := &logrus.Entry{
+		Message: "msg",
+		Time:    time.Unix(1500000000, 0).UTC(),
+		Data:    logrus.Fields{"@timestamp": "from user", "@version": 2},
+	}
+
+	b, err := lf.Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"@timestamp":        "2017-07-14T02:40:00Z",
+		"fields.@timestamp": "from user",
+		"@version":          "1",
+		"fields.@version":   float64(2),
+	}
+	for k, v := range expected {
+		if data[k] != v {
+			t.Errorf("expected %s to be '%v' but got '%v'", k, v, data[k])
+		}
+	}
+}
+
+func TestLogstashFormatterTimestampFieldWithPrefix(t *testing.T) {
+	lf := LogstashFormatter{}
+	entry := &logrus.Entry{
+		Message: "msg",
+		Time:    time.Unix(1500000000, 0).UTC(),
+		Data:    logrus.Fields{"@timestamp": "from user", "@version": 2, "@user": "alice"},
+	}
+	prefixed := &logrus.Entry{
+		Message: "msg",
+		Time:    time.Unix(1500000000, 0).UTC(),
+		Data:    logrus.Fields{"_@timestamp": "from user", "_@version": 2},
+	}
+
+	for _, te := range []struct {
+		entry  *logrus.Entry
+		prefix string
+	}{
+		{entry, "@"},
+		{prefixed, "_"},
+	} {
+		b, err := lf.FormatWithPrefix(te.entry, te.prefix)
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{
+			"@timestamp":        "2017-07-14T02:40:00Z",
+			"fields.@timestamp": "from user",
+			"@version":          "1",
+			"fields.@version":   float64(2),
+		}
+		for k, v := range expected {
+			if data[k] != v {
+				t.Errorf("expected %s to be '%v' with prefix '%s' but got '%v'", k, v, te.prefix, data[k])
+			}
+		}
+		if _, ok := data["timestamp"]; ok {
+			t.Errorf("expected @timestamp to not be renamed with prefix '%s' but got %v", te.prefix, data)
+		}
+	}
+}
+
+func TestLogstashFormatterHMAC(t *testing.T) {
+	key := []byte("secret")
+	lf := LogstashFormatter{Type: "abc", HMACKey: key}
+
+	for _, entry := range []*logrus.Entry{
+		{Message: "msg", Data: logrus.Fields{"user": "bob"}},
+		{Message: "msg", Data: logrus.Fields{"hmac": "forged", "_id": 1}},
+	} {
+		b, err := lf.FormatWithPrefix(entry, "_")
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatalf("expected signed document to be JSON but got '%s'", b)
+		}
+		sum, _ := data["hmac"].(string)
+
+		payload := strings.Replace(strings.TrimSpace(string(b)), `,"hmac":"`+sum+`"`, "", 1)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(payload))
+		if expected := hex.EncodeToString(mac.Sum(nil)); sum != expected {
+			t.Errorf("expected hmac of '%s' to be '%s' but got '%s'", payload, expected, sum)
+		}
+		if v, ok := entry.Data["hmac"]; ok && data["fields.hmac"] != v {
+			t.Errorf("expected entry hmac field to be moved to fields.hmac but got '%s'", b)
+		}
+	}
+}
+
+func TestLogstashFormatterCallerPackage(t *testing.T) {
+	lf := LogstashFormatter{CallerPackageKey: "caller.package"}
+	entry := &logrus.Entry{
+		Message: "msg",
+		Data:    logrus.Fields{},
+		Caller:  &runtime.Frame{Function: "github.com/iost-official/logrustash/internal.(*Server).Serve.func1"},
+	}
+
+	b, err := lf.Format(entry)
+	if err != nil {
+		t.Fatalf("expected format to not return error: %s", err)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["caller.package"] != "github.com/iost-official/logrustash/internal" {
+		t.Errorf("expected caller package to be extracted but got '%v'", data["caller.package"])
+	}
+
+	tt := map[string]string{
+		"main.main":                    "main",
+		"net/http.Get":                 "net/http",
+		"gopkg.in/yaml%2ev2.Unmarshal": "gopkg.in/yaml.v2",
+		"nodot":                        "nodot",
+	}
+	for function, expected := range tt {
+		if pkg := callerPackage(function); pkg != expected {
+			t.Errorf("expected package of %s to be '%s' but got '%s'", function, expected, pkg)
+		}
+	}
+}
+
+func TestLogstashFormatterNonFiniteFloats(t *testing.T) {
+	entry := &logrus.Entry{
+		Message: "msg",
+		Data: logrus.Fields{
+			"nan":    math.NaN(),
+			"inf":    math.Inf(1),
+			"neginf": float32(math.Inf(-1)),
+			"finite": float32(1.5),
+		},
+	}
+
+	tt := []struct {
+		formatter LogstashFormatter
+		expected  map[string]interface{}
+	}{
+		{LogstashFormatter{}, map[string]interface{}{"nan": nil, "inf": nil, "neginf": nil, "finite": 1.5}},
+		{LogstashFormatter{NonFiniteFloats: NonFiniteAsString}, map[string]interface{}{"nan": "NaN", "inf": "+Inf", "neginf": "-Inf", "finite": 1.5}},
+		// RawLevelKey disables the fast path.
+		{LogstashFormatter{NonFiniteFloats: NonFiniteAsString, RawLevelKey: "lvl"}, map[string]interface{}{"nan": "NaN", "inf": "+Inf", "neginf": "-Inf", "finite": 1.5}},
+	}
+
+	for _, te := range tt {
+		b, err := te.formatter.Format(entry)
+		if err != nil {
+			t.Fatalf("expected format to not return error: %s", err)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range te.expected {
+			if value, ok := data[k]; !ok || value != v {
+				t.Errorf("expected %s to be '%v' but got '%v'", k, v, data[k])
+			}
+		}
+	}
+
+	if _, err := (&LogstashFormatter{NonFiniteFloats: NonFiniteAsError}).Format(entry); err == nil {
+		t.Error("expected format to return error")
+	}
+}
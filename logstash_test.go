@@ -2,10 +2,28 @@ package logrustash
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -368,3 +386,2979 @@ func TestLogstashTimeStampFormat(t *testing.T) {
 		t.Errorf("expected time to be '%s' but got '%s'", "3:04AM", value)
 	}
 }
+
+type NoDeadlineConnMock struct {
+	ConnMock
+	deadlineCalls *int
+}
+
+func (c NoDeadlineConnMock) SetWriteDeadline(t time.Time) error {
+	*c.deadlineCalls++
+	return fmt.Errorf("deadline not supported")
+}
+
+func TestFireWithUnsupportedWriteDeadline(t *testing.T) {
+	var deadlineCalls int
+	conn := NoDeadlineConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, deadlineCalls: &deadlineCalls}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		Timeout:          time.Second,
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+			t.Errorf("expected fire to not return error: %s", err)
+		}
+	}
+
+	if lines := strings.Count(conn.buff.String(), "\n"); lines != 2 {
+		t.Errorf("expected 2 messages to be sent but got %d", lines)
+	}
+	if deadlineCalls != 1 {
+		t.Errorf("expected write deadline to be tried once but got %d", deadlineCalls)
+	}
+}
+
+func TestFireWithRequiredWriteDeadline(t *testing.T) {
+	var deadlineCalls int
+	conn := NoDeadlineConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, deadlineCalls: &deadlineCalls}
+	hook := &Hook{
+		conn:                 conn,
+		alwaysSentFields:     logrus.Fields{},
+		Timeout:              time.Second,
+		RequireWriteDeadline: true,
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err == nil {
+		t.Error("expected fire to return error")
+	}
+	if conn.buff.Len() != 0 {
+		t.Errorf("expected nothing to be sent but got '%s'", conn.buff.String())
+	}
+}
+
+func TestAsyncDeadLetter(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewAsyncHookWithFieldsAndConn(conn, "dead_letter", logrus.Fields{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type deadLetter struct {
+		entry *logrus.Entry
+		err   error
+	}
+	deadLetters := make(chan deadLetter, 1)
+	hook.WaitUntilBufferFrees = true
+	hook.DeadLetter = func(entry *logrus.Entry, err error) {
+		deadLetters <- deadLetter{entry, err}
+	}
+
+	entry := &logrus.Entry{Message: "unmarshalable", Data: logrus.Fields{"chan": make(chan int)}}
+	if err := hook.Fire(entry); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case dl := <-deadLetters:
+		if dl.entry != entry {
+			t.Errorf("expected dead letter entry to be '%v' but got '%v'", entry, dl.entry)
+		}
+		if dl.err == nil {
+			t.Error("expected dead letter error to be not nil")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected dead letter callback to be called")
+	}
+}
+
+func TestMaxLineBytes(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	var diverted []string
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		MaxLineBytes:     200,
+		DeadLetter: func(entry *logrus.Entry, err error) {
+			if err != ErrLineTooLong {
+				t.Errorf("expected dead letter error to be '%v' but got '%v'", ErrLineTooLong, err)
+			}
+			diverted = append(diverted, entry.Message)
+		},
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: strings.Repeat("x", 200)}); err != ErrLineTooLong {
+		t.Errorf("expected fire to return '%v' but got '%v'", ErrLineTooLong, err)
+	}
+	if conn.buff.Len() != 0 {
+		t.Errorf("expected oversized message to not be written but got '%s'", conn.buff)
+	}
+	if len(diverted) != 1 {
+		t.Errorf("expected oversized message to be passed to dead letter but got %v", diverted)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "short"}); err != nil {
+		t.Error(err)
+	}
+	if conn.buff.Len() == 0 {
+		t.Error("expected short message to be written")
+	}
+
+	if err := hook.SendRaw([]byte(strings.Repeat("x", 200))); err != ErrLineTooLong {
+		t.Errorf("expected send to return '%v' but got '%v'", ErrLineTooLong, err)
+	}
+}
+
+func TestReconnectResolvesHostname(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	address := net.JoinHostPort("localhost", port)
+
+	var dialed []string
+	hook := &Hook{
+		protocol: "tcp",
+		address:  address,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			return net.Dial(protocol, address)
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := hook.reconnect(context.Background()); err != nil {
+			t.Fatalf("expected reconnect to not return error: %s", err)
+		}
+	}
+
+	expected := []string{address, address}
+	if !reflect.DeepEqual(expected, dialed) {
+		t.Errorf("expected dialed addresses to be '%v' but got '%v'", expected, dialed)
+	}
+	if hook.conn == nil {
+		t.Error("expected conn to be not nil")
+	}
+}
+
+func TestFireWithCorrelationID(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	ids := []string{"req-1", "req-2"}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		CorrelationIDKey: "request_id",
+		CorrelationIDFunc: func() string {
+			id := ids[0]
+			ids = ids[1:]
+			return id
+		},
+	}
+
+	for _, expected := range []string{"req-1", "req-2"} {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]string
+		if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+			t.Error(err)
+		}
+		if res["request_id"] != expected {
+			t.Errorf("expected request_id to be '%s' but got '%s'", expected, res["request_id"])
+		}
+	}
+}
+
+func TestCloseStopsWorker(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewAsyncHookWithFieldsAndConn(conn, "close_test", logrus.Fields{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.WaitUntilBufferFrees = true
+
+	for i := 0; i < 3; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := hook.Close(); err != nil {
+		t.Errorf("expected close to not return error: %s", err)
+	}
+
+	if lines := strings.Count(conn.buff.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 messages to be sent before close but got %d", lines)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("expected %d goroutines after close but got %d", before, after)
+	}
+}
+
+func TestFireConcurrentWithClose(t *testing.T) {
+	// The worker is blocked in write, so the buffer is full and fire waits for it when the hook is closed.
+	conn := BlockingConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, release: make(chan struct{})}
+	hook := &Hook{
+		conn:                 conn,
+		alwaysSentFields:     logrus.Fields{},
+		AsyncBufferSize:      1,
+		WaitUntilBufferFrees: true,
+	}
+	hook.makeAsync()
+
+	var sent int32
+	done := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			if err := hook.Fire(&logrus.Entry{Message: "hello"}); err == nil {
+				atomic.AddInt32(&sent, 1)
+			} else if err != ErrHookClosed {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan error)
+	go func() {
+		closed <- hook.Close()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(conn.release)
+	if err := <-closed; err != nil {
+		t.Errorf("expected close to not return error: %s", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected fire to not block after close")
+		}
+	}
+
+	hook.RLock()
+	defer hook.RUnlock()
+	if lines := strings.Count(conn.buff.String(), "\n"); lines != int(atomic.LoadInt32(&sent)) {
+		t.Errorf("expected all %d accepted messages to be sent but got %d", sent, lines)
+	}
+}
+
+func TestFireRacingClose(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	entered, proceed := make(chan struct{}), make(chan struct{})
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		AsyncBufferSize:  1,
+		// Holds fire after the closed check until the hook is closed.
+		CorrelationIDFunc: func() string {
+			close(entered)
+			<-proceed
+			return "id"
+		},
+	}
+	hook.makeAsync()
+
+	fired := make(chan error)
+	go func() {
+		fired <- hook.Fire(&logrus.Entry{Message: "hello"})
+	}()
+	<-entered
+	if err := hook.Close(); err != nil {
+		t.Errorf("expected close to not return error: %s", err)
+	}
+	close(proceed)
+
+	if err := <-fired; err != ErrHookClosed {
+		t.Errorf("expected fire racing close to return '%v' but got '%v'", ErrHookClosed, err)
+	}
+}
+
+func TestShutdownFlush(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewAsyncHookWithFieldsAndConn(conn, "flush_test", logrus.Fields{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.WaitUntilBufferFrees = true
+
+	signals := make(chan os.Signal, 1)
+	released := false
+	stop := hook.listenShutdownFlush(signals, time.Second, func() { released = true })
+
+	for i := 0; i < 3; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	signals <- syscall.SIGTERM
+	stop()
+
+	if lines := strings.Count(conn.buff.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 messages to be flushed but got %d", lines)
+	}
+	if !released {
+		t.Error("expected signals to be released after flush")
+	}
+	select {
+	case <-hook.done:
+	default:
+		t.Error("expected async worker to be stopped")
+	}
+}
+
+func TestShutdownFlushStop(t *testing.T) {
+	hook, err := NewAsyncHookWithFieldsAndConn(ConnMock{buff: bytes.NewBufferString("")}, "flush_test", logrus.Fields{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+
+	signals := make(chan os.Signal, 1)
+	released := false
+	stop := hook.listenShutdownFlush(signals, time.Second, func() { released = true })
+	stop()
+	stop()
+
+	if !released {
+		t.Error("expected signals to be released on stop")
+	}
+	signals <- syscall.SIGTERM
+	if hook.isClosed() {
+		t.Error("expected hook to not be flushed after stop")
+	}
+
+	// Only the first call installs the signal listener, later calls return the same stop.
+	stop = hook.InstallShutdownFlush(time.Second)
+	hook.InstallShutdownFlush(time.Second)()
+	stop()
+}
+
+type BlockingConnMock struct {
+	ConnMock
+	release chan struct{}
+}
+
+func (c BlockingConnMock) Write(b []byte) (int, error) {
+	<-c.release
+	return c.ConnMock.Write(b)
+}
+
+func TestShutdownWithExpiredContext(t *testing.T) {
+	conn := BlockingConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, release: make(chan struct{})}
+	hook, err := NewAsyncHookWithFieldsAndConn(conn, "shutdown_test", logrus.Fields{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.WaitUntilBufferFrees = true
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := hook.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected shutdown to return '%v' but got '%v'", context.DeadlineExceeded, err)
+	}
+
+	close(conn.release)
+	hook.workerWG.Wait()
+}
+
+type netErrorMock struct {
+	temporary bool
+	timeout   bool
+}
+
+func (e netErrorMock) Error() string {
+	return "net error mock"
+}
+
+func (e netErrorMock) Temporary() bool {
+	return e.temporary
+}
+
+func (e netErrorMock) Timeout() bool {
+	return e.timeout
+}
+
+type FailingConnMock struct {
+	ConnMock
+	err    error
+	writes *int
+}
+
+func (c FailingConnMock) Write(b []byte) (int, error) {
+	*c.writes++
+	return 0, c.err
+}
+
+type backoffMock struct {
+	retries    []int
+	reconnects []int
+	delays     []int
+}
+
+func (b *backoffMock) NextDelay(attempt int) time.Duration {
+	b.delays = append(b.delays, attempt)
+	return time.Duration(attempt) * time.Millisecond
+}
+
+func (b *backoffMock) ShouldRetry(err error, attempt int) bool {
+	b.retries = append(b.retries, attempt)
+	return attempt < 2
+}
+
+func (b *backoffMock) ShouldReconnect(err error, attempt int) bool {
+	b.reconnects = append(b.reconnects, attempt)
+	return attempt < 3
+}
+
+func TestReconnectAfterFailures(t *testing.T) {
+	var writes, dials int
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:                   FailingConnMock{err: io.ErrClosedPipe, writes: &writes},
+		alwaysSentFields:       logrus.Fields{},
+		protocol:               "tcp",
+		address:                "localhost:9999",
+		ReconnectAfterFailures: 3,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			dials++
+			return conn, nil
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: "lost"}); err == nil {
+			t.Error("expected fire to return error")
+		}
+	}
+	if dials != 0 {
+		t.Errorf("expected no reconnect before threshold but got %d dials", dials)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Errorf("expected fire to succeed after forced reconnect but got: %s", err)
+	}
+	if dials != 1 || writes != 3 {
+		t.Errorf("expected 1 dial after 3 failed writes but got %d dials and %d writes", dials, writes)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "hello" {
+		t.Errorf("expected message to be sent over new connection but got '%v'", res)
+	}
+}
+
+func TestConcurrentFireWaitsForReconnect(t *testing.T) {
+	var writes int
+	var dials int32
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:                FailingConnMock{err: netErrorMock{}, writes: &writes},
+		alwaysSentFields:    logrus.Fields{},
+		protocol:            "tcp",
+		address:             "localhost:9999",
+		MaxReconnectRetries: 1,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			time.Sleep(100 * time.Millisecond)
+			return conn, nil
+		},
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			errs <- hook.Fire(&logrus.Entry{Message: fmt.Sprintf("message %d", i)})
+		}(i)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("expected fire to wait for reconnect but got: %s", err)
+		}
+	}
+
+	if dials := atomic.LoadInt32(&dials); dials != 1 {
+		t.Errorf("expected a single reconnect but got %d dials", dials)
+	}
+	if lines := strings.Count(conn.buff.String(), "\n"); lines != 2 {
+		t.Errorf("expected both messages to be sent over new connection but got '%s'", conn.buff)
+	}
+}
+
+func TestFireResendsOnTimeout(t *testing.T) {
+	var writes, dials int
+	hook := &Hook{
+		conn:                FailingConnMock{err: netErrorMock{timeout: true}, writes: &writes},
+		alwaysSentFields:    logrus.Fields{},
+		protocol:            "tcp",
+		address:             "localhost:9999",
+		MaxSendRetries:      2,
+		MaxReconnectRetries: 1,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			dials++
+			return nil, fmt.Errorf("unexpected dial")
+		},
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err == nil {
+		t.Error("expected fire to return error")
+	}
+	if writes != 3 || dials != 0 {
+		t.Errorf("expected timeout error to be resent twice without reconnect but got %d writes and %d dials", writes, dials)
+	}
+}
+
+func TestFireCtxAbortsReconnect(t *testing.T) {
+	var writes, dials int
+	hook := &Hook{
+		conn:                     FailingConnMock{err: netErrorMock{}, writes: &writes},
+		alwaysSentFields:         logrus.Fields{},
+		protocol:                 "tcp",
+		address:                  "localhost:9999",
+		ReconnectBaseDelay:       time.Hour,
+		ReconnectDelayMultiplier: 1,
+		MaxReconnectRetries:      3,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			dials++
+			return nil, fmt.Errorf("dial error")
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := hook.FireCtx(ctx, &logrus.Entry{Message: "hello"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected fire to return context error but got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected reconnect sleep to be aborted but fire took %s", elapsed)
+	}
+	if writes != 1 || dials != 0 {
+		t.Errorf("expected 1 write and no dials but got %d writes and %d dials", writes, dials)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var writes, dials int
+	hook := &Hook{
+		conn:                     FailingConnMock{err: netErrorMock{}, writes: &writes},
+		alwaysSentFields:         logrus.Fields{},
+		protocol:                 "tcp",
+		address:                  "localhost:9999",
+		ReconnectBaseDelay:       20 * time.Millisecond,
+		ReconnectDelayMultiplier: 1,
+		MaxReconnectRetries:      1000,
+		RetryBudget:              100 * time.Millisecond,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			dials++
+			return FailingConnMock{err: netErrorMock{}, writes: &writes}, nil
+		},
+	}
+
+	start := time.Now()
+	err := hook.Fire(&logrus.Entry{Message: "hello"})
+	elapsed := time.Since(start)
+
+	if err == nil || !strings.Contains(err.Error(), "Retry budget") {
+		t.Errorf("expected fire to return retry budget error but got: %v", err)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected send to stop retrying after the budget but it took %s", elapsed)
+	}
+	if dials < 2 || writes != dials+1 {
+		t.Errorf("expected several reconnects within the budget but got %d dials and %d writes", dials, writes)
+	}
+}
+
+func TestCustomBackoffStrategy(t *testing.T) {
+	var writes, dials int
+	backoff := &backoffMock{}
+	hook := &Hook{
+		conn:             FailingConnMock{err: fmt.Errorf("generic error"), writes: &writes},
+		alwaysSentFields: logrus.Fields{},
+		protocol:         "tcp",
+		address:          "localhost:9999",
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			dials++
+			return nil, fmt.Errorf("dial error")
+		},
+		Backoff: backoff,
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err == nil {
+		t.Error("expected fire to return error")
+	}
+
+	if writes != 3 {
+		t.Errorf("expected 3 writes but got %d", writes)
+	}
+	if dials != 3 {
+		t.Errorf("expected 3 dials but got %d", dials)
+	}
+	tt := []struct {
+		name     string
+		expected []int
+		actual   []int
+	}{
+		{"retries", []int{0, 1, 2}, backoff.retries},
+		{"reconnects", []int{0, 1, 2, 3}, backoff.reconnects},
+		{"delays", []int{0, 1, 2}, backoff.delays},
+	}
+	for _, te := range tt {
+		if !reflect.DeepEqual(te.expected, te.actual) {
+			t.Errorf("expected %s to be '%v' but got '%v'", te.name, te.expected, te.actual)
+		}
+	}
+}
+
+func TestAsyncWorkersPreserveOrderPerKey(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewAsyncHookWithFieldsAndConn(conn, "workers_test", logrus.Fields{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.WaitUntilBufferFrees = true
+	hook.SetAsyncWorkers(4, func(entry *logrus.Entry) string {
+		return entry.Data["session"].(string)
+	})
+
+	sessions := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 100; i++ {
+		entry := &logrus.Entry{
+			Message: "hello",
+			Data:    logrus.Fields{"session": sessions[i%len(sessions)], "seq": i},
+		}
+		if err := hook.Fire(entry); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := hook.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	last := make(map[string]int)
+	dec := json.NewDecoder(conn.buff)
+	count := 0
+	for dec.More() {
+		var res struct {
+			Session string `json:"session"`
+			Seq     int    `json:"seq"`
+		}
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		count++
+
+		if prev, ok := last[res.Session]; ok && prev >= res.Seq {
+			t.Errorf("expected session '%s' entries in order but got %d after %d", res.Session, res.Seq, prev)
+		}
+		last[res.Session] = res.Seq
+	}
+	if count != 100 {
+		t.Errorf("expected 100 messages but got %d", count)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var writes int
+	out := bytes.NewBufferString("")
+	hook := &Hook{
+		conn:             FailingConnMock{err: fmt.Errorf("conn must not be used"), writes: &writes},
+		appName:          "dry_run",
+		alwaysSentFields: logrus.Fields{},
+		DryRun:           true,
+		DryRunWriter:     out,
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{"id": "1"}}); err != nil {
+		t.Error(err)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(out).Decode(&res); err != nil {
+		t.Error(err)
+	}
+	if res["message"] != "hello" || res["id"] != "1" || res["type"] != "dry_run" {
+		t.Errorf("expected formatted entry to be written but got '%v'", res)
+	}
+	if writes != 0 {
+		t.Errorf("expected conn to not be used but got %d writes", writes)
+	}
+}
+
+func TestFireWithNilData(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		appName:          "nil_data",
+		alwaysSentFields: logrus.Fields{"id": "1"},
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Error(err)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Error(err)
+	}
+	if res["message"] != "hello" || res["id"] != "1" {
+		t.Errorf("expected entry with always sent fields but got '%v'", res)
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	conn := BlockingConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, release: make(chan struct{})}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		AsyncBufferSize:  1,
+		OverflowPolicies: map[logrus.Level]OverflowPolicy{
+			logrus.ErrorLevel: OverflowBlock,
+			logrus.DebugLevel: OverflowDrop,
+		},
+	}
+	hook.makeAsync()
+
+	// The first one blocks the worker, the second one fills the buffer.
+	for _, msg := range []string{"first", "second"} {
+		if err := hook.Fire(&logrus.Entry{Message: msg, Level: logrus.InfoLevel}); err != nil {
+			t.Error(err)
+		}
+		for len(hook.fireChannel) > 0 && msg == "first" {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "debug", Level: logrus.DebugLevel}); err != nil {
+		t.Error(err)
+	}
+
+	fired := make(chan struct{})
+	go func() {
+		hook.Fire(&logrus.Entry{Message: "error", Level: logrus.ErrorLevel})
+		close(fired)
+	}()
+
+	select {
+	case <-fired:
+		t.Error("expected error entry to wait until buffer frees")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(conn.release)
+	<-fired
+	if err := hook.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []string
+	dec := json.NewDecoder(conn.buff)
+	for dec.More() {
+		var res map[string]string
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, res["message"])
+	}
+
+	expected := []string{"first", "second", "error"}
+	if !reflect.DeepEqual(expected, messages) {
+		t.Errorf("expected messages to be '%v' but got '%v'", expected, messages)
+	}
+}
+
+func TestFireWithProcessFields(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		IncludeProcess:   true,
+		ProcessNameKey:   "proc",
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Error(err)
+	}
+
+	var res map[string]interface{}
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Error(err)
+	}
+	if res["process.pid"] != float64(os.Getpid()) {
+		t.Errorf("expected process.pid to be '%d' but got '%v'", os.Getpid(), res["process.pid"])
+	}
+	if res["proc"] != filepath.Base(os.Args[0]) {
+		t.Errorf("expected proc to be '%s' but got '%v'", filepath.Base(os.Args[0]), res["proc"])
+	}
+}
+
+type KeepAliveConnMock struct {
+	ConnMock
+	keepAlive *bool
+	period    *time.Duration
+}
+
+func (c KeepAliveConnMock) SetKeepAlive(keepalive bool) error {
+	*c.keepAlive = keepalive
+	return nil
+}
+
+func (c KeepAliveConnMock) SetKeepAlivePeriod(d time.Duration) error {
+	*c.period = d
+	return nil
+}
+
+func TestKeepAlive(t *testing.T) {
+	var keepAlive bool
+	var period time.Duration
+	newConn := func() net.Conn {
+		keepAlive, period = false, 0
+		return KeepAliveConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, keepAlive: &keepAlive, period: &period}
+	}
+
+	hook := &Hook{
+		conn:             newConn(),
+		alwaysSentFields: logrus.Fields{},
+		protocol:         "tcp",
+		address:          "localhost:9999",
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			return newConn(), nil
+		},
+		KeepAlivePeriod: 30 * time.Second,
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Error(err)
+		}
+		if !keepAlive || period != 30*time.Second {
+			t.Errorf("expected keepalive to be enabled with period '%s' but got %v with '%s'", 30*time.Second, keepAlive, period)
+		}
+
+		if err := hook.reconnect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type WriteBufferConnMock struct {
+	ConnMock
+	size *int
+}
+
+func (c WriteBufferConnMock) SetWriteBuffer(bytes int) error {
+	*c.size = bytes
+	return nil
+}
+
+func TestWriteBufferSize(t *testing.T) {
+	var size int
+	newConn := func() net.Conn {
+		size = 0
+		return WriteBufferConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, size: &size}
+	}
+
+	hook := &Hook{
+		conn:             newConn(),
+		alwaysSentFields: logrus.Fields{},
+		protocol:         "tcp",
+		address:          "localhost:9999",
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			return newConn(), nil
+		},
+		WriteBufferSize: 1 << 20,
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Error(err)
+		}
+		if size != 1<<20 {
+			t.Errorf("expected write buffer size to be %d but got %d", 1<<20, size)
+		}
+
+		if err := hook.reconnect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRemoveAndReplaceFields(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{conn: conn, alwaysSentFields: logrus.Fields{}}
+
+	fire := func() map[string]string {
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]string
+		if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+			t.Error(err)
+		}
+
+		return res
+	}
+
+	hook.WithField("leader", "yes")
+	if res := fire(); res["leader"] != "yes" {
+		t.Errorf("expected leader to be '%s' but got '%s'", "yes", res["leader"])
+	}
+
+	hook.RemoveField("leader")
+	if res := fire(); res["leader"] != "" {
+		t.Errorf("expected leader to be removed but got '%s'", res["leader"])
+	}
+
+	fields := logrus.Fields{"shard": "1"}
+	hook.WithField("leader", "no")
+	hook.ReplaceFields(fields)
+	fields["shard"] = "2"
+	if res := fire(); res["leader"] != "" || res["shard"] != "1" {
+		t.Errorf("expected only replaced shard field but got '%v'", res)
+	}
+}
+
+func TestWithEnvironment(t *testing.T) {
+	os.Setenv("LOGRUSTASH_TEST_ENV", "staging")
+	defer os.Unsetenv("LOGRUSTASH_TEST_ENV")
+
+	tt := []struct {
+		key      string
+		envVar   string
+		fallback string
+		expected logrus.Fields
+	}{
+		{"", "LOGRUSTASH_TEST_ENV", "dev", logrus.Fields{"env": "staging"}},
+		{"deployment", "LOGRUSTASH_TEST_ENV", "dev", logrus.Fields{"deployment": "staging"}},
+		{"", "LOGRUSTASH_TEST_UNSET_ENV", "dev", logrus.Fields{"env": "dev"}},
+	}
+
+	for _, te := range tt {
+		hook := NewFilterHook()
+		hook.WithEnvironment(te.key, te.envVar, te.fallback)
+		if !reflect.DeepEqual(te.expected, hook.alwaysSentFields) {
+			t.Errorf("expected alwaysSentFields to be '%v' but got '%v'", te.expected, hook.alwaysSentFields)
+		}
+	}
+}
+
+func TestEnableForwarding(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	hook := NewFilterHookWithPrefix("_")
+	hook.appName = "forwarding"
+	if err := hook.Fire(&logrus.Entry{Message: "filtered"}); err != nil {
+		t.Error(err)
+	}
+
+	if err := hook.EnableForwarding("tcp", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := hook.Fire(&logrus.Entry{Message: "forwarded", Data: logrus.Fields{"_id": "1"}}); err != nil {
+		t.Error(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var res map[string]string
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "forwarded" || res["id"] != "1" || res["type"] != "forwarding" {
+		t.Errorf("expected forwarded entry but got '%v'", res)
+	}
+}
+
+func TestSendWithManyRetries(t *testing.T) {
+	var writes, dials int
+	hook := &Hook{
+		conn:             FailingConnMock{err: netErrorMock{temporary: true}, writes: &writes},
+		alwaysSentFields: logrus.Fields{},
+		protocol:         "tcp",
+		address:          "localhost:9999",
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			dials++
+			return nil, fmt.Errorf("dial error")
+		},
+		MaxSendRetries:      100000,
+		MaxReconnectRetries: 100000,
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err == nil {
+		t.Error("expected fire to return error")
+	}
+	if writes != 100001 {
+		t.Errorf("expected %d writes but got %d", 100001, writes)
+	}
+
+	// Not temporary error leads to reconnect.
+	writes = 0
+	hook.conn = FailingConnMock{err: netErrorMock{}, writes: &writes}
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err == nil {
+		t.Error("expected fire to return error")
+	}
+	if writes != 1 {
+		t.Errorf("expected %d write but got %d", 1, writes)
+	}
+	if dials != 100001 {
+		t.Errorf("expected %d dials but got %d", 100001, dials)
+	}
+}
+
+func TestFireWithHostname(t *testing.T) {
+	expectedHostname, _ := os.Hostname()
+
+	tt := []struct {
+		hook     *Hook
+		key      string
+		expected string
+	}{
+		{&Hook{IncludeHostname: true}, "hostname", expectedHostname},
+		{&Hook{IncludeHostname: true, HostnameKey: "pod", HostnameFunc: func() string {
+			return "web-5d8f7"
+		}}, "pod", "web-5d8f7"},
+	}
+
+	for _, te := range tt {
+		conn := ConnMock{buff: bytes.NewBufferString("")}
+		te.hook.conn = conn
+		te.hook.alwaysSentFields = logrus.Fields{}
+
+		if err := te.hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]string
+		if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+			t.Error(err)
+		}
+		if res[te.key] != te.expected {
+			t.Errorf("expected %s to be '%s' but got '%s'", te.key, te.expected, res[te.key])
+		}
+	}
+}
+
+func TestOnSent(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	var sent []int
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		OnSent: func(entry *logrus.Entry, bytes int) {
+			if entry.Message != "hello" {
+				t.Errorf("expected OnSent to get sent entry but got '%s'", entry.Message)
+			}
+			sent = append(sent, bytes)
+		},
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Error(err)
+	}
+
+	if len(sent) != 1 || sent[0] != conn.buff.Len() {
+		t.Errorf("expected OnSent to be called once with %d bytes but got %v", conn.buff.Len(), sent)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	var writes, written int
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		OnWrite: func(bytes int, latency time.Duration) {
+			writes++
+			written += bytes
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	expected := uint64(conn.buff.Len())
+	if sent := hook.BytesSent(); sent != expected {
+		t.Errorf("expected %d bytes sent but got %d", expected, sent)
+	}
+	if writes != 3 || uint64(written) != expected {
+		t.Errorf("expected OnWrite to be called 3 times with %d bytes but got %d times with %d bytes", expected, writes, written)
+	}
+	if hook.LastSendLatency() < 0 {
+		t.Errorf("expected last send latency to be not negative but got '%s'", hook.LastSendLatency())
+	}
+}
+
+func TestFirePrefixedAlwaysSentFields(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{"_service": "billing", "_id": "from-hook", "team": "core"},
+		hookOnlyPrefix:   "_",
+	}
+	entry := &logrus.Entry{
+		Message: "hello",
+		Data:    logrus.Fields{"id": "from-entry", "_trace": "abc"},
+	}
+
+	if err := hook.Fire(entry); err != nil {
+		t.Error(err)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Error(err)
+	}
+	expected := map[string]string{
+		"service": "billing",
+		"trace":   "abc",
+		"id":      "from-entry",
+		"team":    "core",
+	}
+	for key, value := range expected {
+		if res[key] != value {
+			t.Errorf("expected %s to be '%s' but got '%s'", key, value, res[key])
+		}
+	}
+	for key := range res {
+		if strings.HasPrefix(key, "_") {
+			t.Errorf("expected prefixed keys to be trimmed but got '%s'", key)
+		}
+	}
+
+	// Hook only fields are removed from the entry for the rest of logging.
+	expectedData := logrus.Fields{"id": "from-entry", "team": "core"}
+	if !reflect.DeepEqual(expectedData, entry.Data) {
+		t.Errorf("expected entry data to be '%v' but got '%v'", expectedData, entry.Data)
+	}
+}
+
+func TestConnectHeader(t *testing.T) {
+	var writes int
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	reconnected := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:                conn,
+		alwaysSentFields:    logrus.Fields{},
+		protocol:            "tcp",
+		address:             "localhost:9999",
+		MaxReconnectRetries: 1,
+		ConnectHeader:       []byte("build=1.2.3\n"),
+		Formatter:           &CEFFormatter{},
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			return reconnected, nil
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Error(err)
+		}
+	}
+	lines := strings.Split(conn.buff.String(), "\n")
+	if len(lines) != 4 || lines[0] != "build=1.2.3" || !strings.HasPrefix(lines[1], "CEF:0|") || !strings.HasPrefix(lines[2], "CEF:0|") {
+		t.Errorf("expected header to be written once before messages but got '%s'", conn.buff)
+	}
+
+	hook.setConn(FailingConnMock{err: netErrorMock{}, writes: &writes})
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Error(err)
+	}
+	if res := reconnected.buff.String(); !strings.HasPrefix(res, "build=1.2.3\nCEF:0|") {
+		t.Errorf("expected header to be written after reconnect but got '%s'", res)
+	}
+}
+
+func TestConnectHeaderOnReconnect(t *testing.T) {
+	reconnected := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             ConnMock{buff: bytes.NewBufferString("")},
+		alwaysSentFields: logrus.Fields{},
+		protocol:         "tcp",
+		address:          "localhost:9999",
+		ConnectHeader:    []byte("build=1.2.3\n"),
+		Timeout:          time.Second,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			return reconnected, nil
+		},
+	}
+
+	// No message is pending, e.g. on reconnect by the health check.
+	if err := hook.reconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if res := reconnected.buff.String(); res != "build=1.2.3\n" {
+		t.Errorf("expected header to be written right after reconnect but got '%s'", res)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+		t.Error(err)
+	}
+	if res := reconnected.buff.String(); strings.Count(res, "build=1.2.3") != 1 {
+		t.Errorf("expected header to be written once but got '%s'", res)
+	}
+}
+
+func TestTryFire(t *testing.T) {
+	// No worker reads the buffer, so it is full after the first entry.
+	hook := &Hook{
+		conn:                 ConnMock{buff: bytes.NewBufferString("")},
+		alwaysSentFields:     logrus.Fields{},
+		fireChannel:          make(chan bufferedEntry, 1),
+		WaitUntilBufferFrees: true,
+	}
+
+	if !hook.TryFire(&logrus.Entry{Message: "first"}) {
+		t.Error("expected entry to be enqueued")
+	}
+	if hook.TryFire(&logrus.Entry{Message: "second"}) {
+		t.Error("expected entry to not be enqueued when buffer is full")
+	}
+	if len(hook.fireChannel) != 1 {
+		t.Errorf("expected 1 entry in buffer but got %d", len(hook.fireChannel))
+	}
+
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	syncHook := &Hook{conn: conn, alwaysSentFields: logrus.Fields{}}
+	if !syncHook.TryFire(&logrus.Entry{Message: "sent"}) || conn.buff.Len() == 0 {
+		t.Error("expected entry to be sent by sync hook")
+	}
+}
+
+func TestAppNameFromProcess(t *testing.T) {
+	tt := []struct {
+		appName  string
+		fallback bool
+		expected interface{}
+	}{
+		{"", false, nil},
+		{"", true, filepath.Base(os.Args[0])},
+		{"bob", true, "bob"},
+	}
+
+	for _, te := range tt {
+		conn := ConnMock{buff: bytes.NewBufferString("")}
+		hook, _ := NewHookWithConn(conn, te.appName)
+		hook.AppNameFromProcess = te.fallback
+
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]interface{}
+		if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res["type"] != te.expected {
+			t.Errorf("expected type to be '%v' but got '%v'", te.expected, res["type"])
+		}
+	}
+}
+
+func TestFieldProvider(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{"leader": "static"},
+	}
+	leader := false
+	hook.AddFieldProvider(func() (string, interface{}) {
+		return "leader", leader
+	})
+	hook.AddFieldProvider(func() (string, interface{}) {
+		return "shard", 7
+	})
+
+	if err := hook.Fire(&logrus.Entry{Message: "follower"}); err != nil {
+		t.Error(err)
+	}
+	leader = true
+	if err := hook.Fire(&logrus.Entry{Message: "leader"}); err != nil {
+		t.Error(err)
+	}
+	if err := hook.Fire(&logrus.Entry{Message: "override", Data: logrus.Fields{"shard": 1}}); err != nil {
+		t.Error(err)
+	}
+
+	dec := json.NewDecoder(conn.buff)
+	for _, expected := range []struct {
+		leader bool
+		shard  float64
+	}{{false, 7}, {true, 7}, {true, 1}} {
+		var res map[string]interface{}
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res["leader"] != expected.leader || res["shard"] != expected.shard {
+			t.Errorf("expected leader %v and shard %v but got '%v'", expected.leader, expected.shard, res)
+		}
+	}
+}
+
+type traceIDKey struct{}
+
+type tenantKey struct{}
+
+func TestContextExtractors(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{"tenant": "hook"},
+	}
+	hook.RegisterContextExtractor(func(ctx context.Context) logrus.Fields {
+		if traceID, ok := ctx.Value(traceIDKey{}).(string); ok {
+			return logrus.Fields{"trace.id": traceID}
+		}
+		return nil
+	})
+	hook.RegisterContextExtractor(func(ctx context.Context) logrus.Fields {
+		if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+			return logrus.Fields{"tenant": tenant, "trace.id": "ignored"}
+		}
+		return nil
+	})
+
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "abc")
+	ctx = context.WithValue(ctx, tenantKey{}, "acme")
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Context: ctx}); err != nil {
+		t.Error(err)
+	}
+	if err := hook.Fire(&logrus.Entry{Message: "without context"}); err != nil {
+		t.Error(err)
+	}
+
+	dec := json.NewDecoder(conn.buff)
+	for _, expected := range []map[string]interface{}{
+		{"trace.id": "abc", "tenant": "acme"},
+		{"trace.id": nil, "tenant": "hook"},
+	} {
+		var res map[string]interface{}
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res["trace.id"] != expected["trace.id"] || res["tenant"] != expected["tenant"] {
+			t.Errorf("expected fields %v but got '%v'", expected, res)
+		}
+	}
+}
+
+func TestFieldsPrecedence(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{"user": "hook", "env": "hook", "region": "hook"},
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.Hooks.Add(hook)
+
+	base := logger.WithFields(logrus.Fields{"user": "logger", "env": "logger"})
+	base.WithField("user", "call").Info("hello")
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"user":   "call",
+		"env":    "logger",
+		"region": "hook",
+	}
+	for key, value := range expected {
+		if res[key] != value {
+			t.Errorf("expected %s to be '%s' but got '%s'", key, value, res[key])
+		}
+	}
+}
+
+func TestFireWithLengthPrefixFraming(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		Framing:          LengthPrefixFraming,
+	}
+
+	for _, msg := range []string{"hello", "world!"} {
+		if err := hook.Fire(&logrus.Entry{Message: msg}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, msg := range []string{"hello", "world!"} {
+		var length uint32
+		if err := binary.Read(conn.buff, binary.BigEndian, &length); err != nil {
+			t.Fatal(err)
+		}
+
+		payload := conn.buff.Next(int(length))
+		if len(payload) != int(length) || bytes.HasSuffix(payload, []byte{'\n'}) {
+			t.Fatalf("expected payload of %d bytes without newline but got '%s'", length, payload)
+		}
+
+		var res map[string]string
+		if err := json.Unmarshal(payload, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res["message"] != msg {
+			t.Errorf("expected message to be '%s' but got '%s'", msg, res["message"])
+		}
+	}
+}
+
+type FlakyConnMock struct {
+	ConnMock
+	failures *int
+}
+
+func (c FlakyConnMock) Write(b []byte) (int, error) {
+	if *c.failures > 0 {
+		*c.failures--
+		return 0, netErrorMock{temporary: true}
+	}
+
+	return c.ConnMock.Write(b)
+}
+
+func TestSendAttempts(t *testing.T) {
+	for _, framing := range []Framing{NewlineFraming, LengthPrefixFraming} {
+		failures := 1
+		conn := FlakyConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, failures: &failures}
+		hook := &Hook{
+			conn:             conn,
+			alwaysSentFields: logrus.Fields{},
+			Framing:          framing,
+			MaxSendRetries:   1,
+			SendAttemptsKey:  "send_attempts",
+		}
+
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Errorf("expected fire to succeed after retry but got: %s", err)
+		}
+
+		b := conn.buff.Bytes()
+		if framing == LengthPrefixFraming {
+			if size := binary.BigEndian.Uint32(b); int(size) != len(b)-4 {
+				t.Errorf("expected length prefix to be %d but got %d", len(b)-4, size)
+			}
+			b = b[4:]
+		}
+		var res map[string]interface{}
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatalf("expected message to be JSON but got '%s'", b)
+		}
+		if res["send_attempts"] != float64(2) || res["message"] != "hello" {
+			t.Errorf("expected message to record 2 send attempts but got '%s'", b)
+		}
+	}
+}
+
+func TestSendAttemptsSigned(t *testing.T) {
+	key := []byte("secret")
+	failures := 1
+	conn := FlakyConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, failures: &failures}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		Formatter:        &LogstashFormatter{HMACKey: key},
+		MaxSendRetries:   1,
+		SendAttemptsKey:  "send_attempts",
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Errorf("expected fire to succeed after retry but got: %s", err)
+	}
+
+	b := conn.buff.Bytes()
+	var res map[string]interface{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatalf("expected message to be JSON but got '%s'", b)
+	}
+	if res["send_attempts"] != float64(2) {
+		t.Errorf("expected message to record 2 send attempts but got '%s'", b)
+	}
+
+	sum, _ := res["hmac"].(string)
+	payload := strings.Replace(strings.TrimSpace(string(b)), `,"hmac":"`+sum+`"`, "", 1)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	if expected := hex.EncodeToString(mac.Sum(nil)); sum != expected {
+		t.Errorf("expected hmac of '%s' to be '%s' but got '%s'", payload, expected, sum)
+	}
+
+	// Entry field with the same name is sent instead of the count.
+	conn.buff.Reset()
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{"send_attempts": "user"}}); err != nil {
+		t.Errorf("expected fire to succeed but got: %s", err)
+	}
+	if b := conn.buff.String(); strings.Count(b, `"send_attempts"`) != 1 || !strings.Contains(b, `"send_attempts":"user"`) {
+		t.Errorf("expected entry field to be sent once but got '%s'", b)
+	}
+}
+
+func TestSendRaw(t *testing.T) {
+	failures := 1
+	conn := FlakyConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, failures: &failures}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		MaxSendRetries:   1,
+	}
+
+	if err := hook.SendRaw([]byte(`{"message":"forwarded"}`)); err != nil {
+		t.Errorf("expected send to succeed after retry but got: %s", err)
+	}
+	if err := hook.SendRaw([]byte("{\"message\":\"with newline\"}\n")); err != nil {
+		t.Error(err)
+	}
+
+	expected := "{\"message\":\"forwarded\"}\n{\"message\":\"with newline\"}\n"
+	if res := conn.buff.String(); res != expected {
+		t.Errorf("expected raw data to be '%s' but got '%s'", expected, res)
+	}
+
+	failures = 2
+	if err := hook.SendRaw([]byte(`{}`)); err == nil {
+		t.Error("expected send to fail when retries are exhausted")
+	}
+}
+
+func TestFireWithLogstashFormatterOptions(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		appName:          "options",
+		alwaysSentFields: logrus.Fields{},
+		TimeFormat:       time.Kitchen,
+		Formatter:        &LogstashFormatter{RawLevelKey: "level_raw"},
+	}
+
+	fTime := time.Date(2009, time.November, 10, 3, 4, 0, 0, time.UTC)
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Time: fTime, Level: logrus.InfoLevel}); err != nil {
+		t.Error(err)
+	}
+
+	var res map[string]interface{}
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Error(err)
+	}
+	expected := map[string]interface{}{
+		"type":       "options",
+		"@timestamp": "3:04AM",
+		"level_raw":  float64(logrus.InfoLevel),
+	}
+	for key, value := range expected {
+		if res[key] != value {
+			t.Errorf("expected %s to be '%v' but got '%v'", key, value, res[key])
+		}
+	}
+}
+
+type ShortWriteConnMock struct {
+	ConnMock
+	maxWrite int
+	writes   *int
+}
+
+func (c ShortWriteConnMock) Write(b []byte) (int, error) {
+	*c.writes++
+	if len(b) > c.maxWrite {
+		b = b[:c.maxWrite]
+	}
+
+	return c.ConnMock.Write(b)
+}
+
+func TestFireWithShortWrites(t *testing.T) {
+	var writes int
+	conn := ShortWriteConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, maxWrite: 0, writes: &writes}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		MaxSendRetries:   2,
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err == nil {
+		t.Error("expected fire to return error when connection accepts no data")
+	}
+	if writes != 3 {
+		t.Errorf("expected 3 writes but got %d", writes)
+	}
+
+	// Partial writes are continued.
+	writes = 0
+	conn.maxWrite = 10
+	hook.conn = conn
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Errorf("expected fire to not return error: %s", err)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "hello" {
+		t.Errorf("expected message to be '%s' but got '%s'", "hello", res["message"])
+	}
+	if writes < 2 {
+		t.Errorf("expected several partial writes but got %d", writes)
+	}
+}
+
+type PartialWriteConnMock struct {
+	ConnMock
+	closed *bool
+}
+
+func (c PartialWriteConnMock) Write(b []byte) (int, error) {
+	n, _ := c.ConnMock.Write(b[:len(b)/2])
+	return n, netErrorMock{}
+}
+
+func (c PartialWriteConnMock) Close() error {
+	*c.closed = true
+	return nil
+}
+
+type CloseCountingConnMock struct {
+	ConnMock
+	closes *int32
+}
+
+func (c CloseCountingConnMock) Close() error {
+	atomic.AddInt32(c.closes, 1)
+	return nil
+}
+
+func TestIdleTimeout(t *testing.T) {
+	var closes, dials int32
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             CloseCountingConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, closes: &closes},
+		alwaysSentFields: logrus.Fields{},
+		protocol:         "tcp",
+		address:          "localhost:9999",
+		IdleTimeout:      20 * time.Millisecond,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return conn, nil
+		},
+	}
+	defer hook.Close()
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&closes) == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&closes) != 1 {
+		t.Fatal("expected idle connection to be closed")
+	}
+	if atomic.LoadInt32(&dials) != 0 {
+		t.Errorf("expected no dials before the next message but got %d", dials)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "again"}); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Errorf("expected connection to be dialed on the next message but got %d dials", dials)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "again" {
+		t.Errorf("expected message to be sent over new connection but got '%v'", res)
+	}
+}
+
+func TestPartialWriteWithoutReconnect(t *testing.T) {
+	var closed bool
+	var dials int
+	broken := PartialWriteConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, closed: &closed}
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             broken,
+		alwaysSentFields: logrus.Fields{},
+		protocol:         "tcp",
+		address:          "localhost:9999",
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			dials++
+			return conn, nil
+		},
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "lost"}); err == nil {
+		t.Error("expected fire to return error")
+	}
+	if !closed || dials != 0 {
+		t.Errorf("expected connection to be closed without reconnect after partial write but got %d dials", dials)
+	}
+
+	// The next message isn't glued to the fragment.
+	if err := hook.Fire(&logrus.Entry{Message: "next"}); err != nil {
+		t.Fatal(err)
+	}
+	if dials != 1 || bytes.Contains(broken.buff.Bytes(), []byte("next")) {
+		t.Errorf("expected next message to be sent over new connection but got %d dials and '%s'", dials, broken.buff)
+	}
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "next" {
+		t.Errorf("expected next message to be sent whole but got '%v'", res)
+	}
+}
+
+func TestReconnectAfterPartialWrite(t *testing.T) {
+	var closed bool
+	broken := PartialWriteConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, closed: &closed}
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:                broken,
+		alwaysSentFields:    logrus.Fields{},
+		protocol:            "tcp",
+		address:             "localhost:9999",
+		MaxSendRetries:      3,
+		MaxReconnectRetries: 1,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			return conn, nil
+		},
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Errorf("expected fire to succeed after reconnect but got: %s", err)
+	}
+
+	if !closed {
+		t.Error("expected connection to be closed after partial write")
+	}
+	if broken.buff.Len() == 0 || bytes.HasSuffix(broken.buff.Bytes(), []byte("\n")) {
+		t.Errorf("expected only a fragment to be written to broken connection but got '%s'", broken.buff)
+	}
+
+	if lines := bytes.Count(conn.buff.Bytes(), []byte("\n")); lines != 1 {
+		t.Errorf("expected one message over new connection but got '%s'", conn.buff)
+	}
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "hello" {
+		t.Errorf("expected complete message to be sent over new connection but got '%v'", res)
+	}
+}
+
+func TestReconnectValidatesConn(t *testing.T) {
+	var closes int32
+	unusable := CloseCountingConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, closes: &closes}
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	dialed := []net.Conn{unusable, conn}
+	var validated []net.Conn
+	hook := &Hook{
+		conn:                FailingConnMock{err: netErrorMock{}, writes: new(int)},
+		alwaysSentFields:    logrus.Fields{},
+		protocol:            "tcp",
+		address:             "localhost:9999",
+		MaxReconnectRetries: 3,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			next := dialed[0]
+			dialed = dialed[1:]
+			return next, nil
+		},
+		ValidateConn: func(c net.Conn) error {
+			validated = append(validated, c)
+			if c == unusable {
+				return io.EOF
+			}
+			return nil
+		},
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Fatalf("expected fire to succeed after the second reconnect but got: %s", err)
+	}
+	if len(validated) != 2 || len(dialed) != 0 {
+		t.Errorf("expected both dialed connections to be validated but got %d", len(validated))
+	}
+	if atomic.LoadInt32(&closes) != 1 || unusable.buff.Len() != 0 {
+		t.Errorf("expected connection which failed validation to be closed without writes but got '%s'", unusable.buff)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "hello" {
+		t.Errorf("expected message to be sent over validated connection but got '%v'", res)
+	}
+}
+
+func TestDeliveryBestEffort(t *testing.T) {
+	var writes int
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:                FailingConnMock{err: netErrorMock{}, writes: &writes},
+		alwaysSentFields:    logrus.Fields{},
+		protocol:            "tcp",
+		address:             "localhost:9999",
+		MaxReconnectRetries: 1,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			return conn, nil
+		},
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Fatalf("expected message to be resent after reconnect but got: %s", err)
+	}
+	if writes != 1 || !strings.Contains(conn.buff.String(), `"message":"hello"`) {
+		t.Errorf("expected message to be resent over new connection but got '%s'", conn.buff)
+	}
+}
+
+func TestDeliveryAtMostOnce(t *testing.T) {
+	var writes int
+	var dials int32
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:                 FailingConnMock{err: netErrorMock{}, writes: &writes},
+		alwaysSentFields:     logrus.Fields{},
+		protocol:             "tcp",
+		address:              "localhost:9999",
+		MaxSendRetries:       3,
+		WaitUntilBufferFrees: true,
+		DeliveryMode:         AtMostOnce,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return conn, nil
+		},
+	}
+
+	if hook.isNeedToWaitForBuffer(logrus.ErrorLevel) {
+		t.Error("expected full buffer to drop messages")
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "lost"}); err == nil {
+		t.Error("expected fire to return error")
+	}
+	if writes != 1 {
+		t.Errorf("expected message to not be resent but got %d writes", writes)
+	}
+
+	for deadline := time.Now().Add(time.Second); hook.isReconnecting() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Fatalf("expected connection to be replaced in background but got %d dials", dials)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "next"}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(conn.buff.String(), "lost") || !strings.Contains(conn.buff.String(), `"message":"next"`) {
+		t.Errorf("expected only the next message to be sent over new connection but got '%s'", conn.buff)
+	}
+}
+
+func TestDeliveryAtLeastOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrustash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var writes, dials int
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             FailingConnMock{err: netErrorMock{}, writes: &writes},
+		alwaysSentFields: logrus.Fields{},
+		protocol:         "tcp",
+		address:          "localhost:9999",
+		SpillDir:         dir,
+		DeliveryMode:     AtLeastOnce,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			// Logstash is down during the first send: the first dial and 3 reconnect retries fail.
+			dials++
+			if dials <= 4 {
+				return nil, netErrorMock{}
+			}
+			return conn, nil
+		},
+	}
+
+	if !hook.isNeedToWaitForBuffer(logrus.DebugLevel) {
+		t.Error("expected full buffer to wait")
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Fatalf("expected message to be saved when logstash is down but got: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spillFileName)); err != nil {
+		t.Fatalf("expected message to be spilled but got: %s", err)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "next"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []string
+	dec := json.NewDecoder(conn.buff)
+	for dec.More() {
+		var res map[string]string
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, res["message"])
+	}
+	if expected := []string{"next", "hello"}; !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected messages %v to be delivered after reconnect but got %v", expected, messages)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spillFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected spill file to be removed after replay but got: %v", err)
+	}
+
+	hook.SpillDir = ""
+	if err := hook.Fire(&logrus.Entry{Message: "unsaved"}); err != ErrSpillDirRequired {
+		t.Errorf("expected fire without SpillDir to return '%v' but got '%v'", ErrSpillDirRequired, err)
+	}
+	if _, err := New(Config{DeliveryMode: AtLeastOnce}); err == nil {
+		t.Error("expected new to return error without SpillDir")
+	}
+}
+
+func TestAsyncBatchDrain(t *testing.T) {
+	var writes int
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		AsyncBufferSize:  10,
+		BatchDrain:       true,
+		OnWrite: func(bytes int, latency time.Duration) {
+			writes++
+		},
+	}
+	hook.makeAsync()
+
+	// Keep the worker busy until all entries are buffered.
+	hook.Lock()
+	for i := 0; i < 6; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: fmt.Sprintf("hello %d", i)}); err != nil {
+			t.Error(err)
+		}
+	}
+	hook.Unlock()
+
+	if err := hook.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(conn.buff.String(), "\n"); lines != 6 {
+		t.Errorf("expected 6 messages but got %d", lines)
+	}
+	if writes > 2 {
+		t.Errorf("expected buffered messages to be sent in batches but got %d writes", writes)
+	}
+}
+
+type DiscardConnMock struct {
+	ConnMock
+}
+
+func (c DiscardConnMock) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func benchmarkAsyncFire(b *testing.B, batchDrain bool) {
+	hook := &Hook{
+		conn:                 DiscardConnMock{},
+		alwaysSentFields:     logrus.Fields{},
+		AsyncBufferSize:      8192,
+		WaitUntilBufferFrees: true,
+		BatchDrain:           batchDrain,
+	}
+	hook.makeAsync()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{"i": i}})
+	}
+	hook.Close()
+}
+
+func BenchmarkAsyncFire(b *testing.B) {
+	benchmarkAsyncFire(b, false)
+}
+
+func BenchmarkAsyncFireBatchDrain(b *testing.B) {
+	benchmarkAsyncFire(b, true)
+}
+
+func TestAsyncReconnectDoesNotBlockWorker(t *testing.T) {
+	var writes int
+	newConn := ConnMock{buff: bytes.NewBufferString("")}
+	releaseDial := make(chan struct{})
+	hook := &Hook{
+		conn:                 FailingConnMock{err: netErrorMock{}, writes: &writes},
+		alwaysSentFields:     logrus.Fields{},
+		protocol:             "tcp",
+		address:              "localhost:9999",
+		AsyncBufferSize:      2,
+		WaitUntilBufferFrees: true,
+		MaxReconnectRetries:  1,
+		AsyncReconnect:       true,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			<-releaseDial
+			return newConn, nil
+		},
+	}
+	hook.makeAsync()
+
+	fired := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			hook.Fire(&logrus.Entry{Message: "during outage"})
+		}
+		close(fired)
+	}()
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("expected worker to keep draining the buffer while reconnecting")
+	}
+
+	close(releaseDial)
+	for hook.isReconnecting() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "after reconnect"}); err != nil {
+		t.Error(err)
+	}
+	if err := hook.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// Messages buffered after reconnect are sent to the new connection as well.
+	var res map[string]string
+	dec := json.NewDecoder(newConn.buff)
+	for dec.More() {
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res["message"] != "after reconnect" {
+		t.Errorf("expected last message to be '%s' but got '%s'", "after reconnect", res["message"])
+	}
+	if writes != 1 {
+		t.Errorf("expected single write to the broken connection but got %d", writes)
+	}
+}
+
+func BenchmarkFire(b *testing.B) {
+	hook := &Hook{
+		conn:             DiscardConnMock{},
+		alwaysSentFields: logrus.Fields{"app": "bench"},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{"i": i, "user": "bob"}})
+	}
+}
+
+func TestAsyncMaxBufferAge(t *testing.T) {
+	conn := BlockingConnMock{ConnMock: ConnMock{buff: bytes.NewBufferString("")}, release: make(chan struct{})}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		AsyncBufferSize:  4,
+		MaxBufferAge:     50 * time.Millisecond,
+	}
+	hook.makeAsync()
+
+	// The first one blocks the worker, the second one waits in the buffer until it becomes stale.
+	for _, msg := range []string{"first", "stale"} {
+		if err := hook.Fire(&logrus.Entry{Message: msg}); err != nil {
+			t.Error(err)
+		}
+		for len(hook.fireChannel) > 0 && msg == "first" {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := hook.Fire(&logrus.Entry{Message: "fresh"}); err != nil {
+		t.Error(err)
+	}
+
+	close(conn.release)
+	if err := hook.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []string
+	dec := json.NewDecoder(conn.buff)
+	for dec.More() {
+		var res map[string]string
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, res["message"])
+	}
+
+	expected := []string{"first", "fresh"}
+	if !reflect.DeepEqual(expected, messages) {
+		t.Errorf("expected messages to be '%v' but got '%v'", expected, messages)
+	}
+}
+
+func TestAsyncBufferDepth(t *testing.T) {
+	hook := &Hook{
+		conn:               ConnMock{buff: bytes.NewBufferString("")},
+		alwaysSentFields:   logrus.Fields{},
+		fireChannel:        make(chan bufferedEntry, 4), // No worker, so entries stay in the buffer.
+		IncludeBufferDepth: true,
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Error(err)
+		}
+	}
+	if !hook.TryFire(&logrus.Entry{Message: "hello"}) {
+		t.Error("expected entry to be put to the buffer")
+	}
+
+	for expected := 0; expected < 4; expected++ {
+		buffered := <-hook.fireChannel
+		if depth := buffered.entry.Data["buffer_depth"]; depth != expected {
+			t.Errorf("expected buffer depth to be %d but got %v", expected, depth)
+		}
+	}
+}
+
+func TestFireWithSchemaVersion(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.SchemaVersion = "2"
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["log_schema_version"] != "2" {
+		t.Errorf("expected schema version to be '2' but got '%v'", res)
+	}
+
+	hook.SchemaVersionKey = "schema"
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res = nil
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["schema"] != "2" {
+		t.Errorf("expected schema version under configured key but got '%v'", res)
+	}
+}
+
+func TestFireWithPartitionKey(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.PartitionKeyFunc = func(entry *logrus.Entry) string {
+		user, _ := entry.Data["user"].(string)
+		return user
+	}
+
+	for _, te := range []struct {
+		fields   logrus.Fields
+		expected interface{}
+	}{
+		{logrus.Fields{"user": "alice"}, "alice"},
+		{logrus.Fields{"user": "bob"}, "bob"},
+		{logrus.Fields{}, nil},
+	} {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Data: te.fields}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]interface{}
+		if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res["partition_key"] != te.expected {
+			t.Errorf("expected partition key to be '%v' but got '%v'", te.expected, res["partition_key"])
+		}
+	}
+}
+
+type AttemptsConnMock struct {
+	ConnMock
+	attempts *[][]byte
+	failures *int
+}
+
+func (c AttemptsConnMock) Write(b []byte) (int, error) {
+	*c.attempts = append(*c.attempts, append([]byte(nil), b...))
+	if *c.failures > 0 {
+		*c.failures--
+		return 0, netErrorMock{temporary: true}
+	}
+
+	return len(b), nil
+}
+
+func TestFireWithEventID(t *testing.T) {
+	var attempts [][]byte
+	failures := 2
+	hook := &Hook{
+		conn:             AttemptsConnMock{attempts: &attempts, failures: &failures},
+		alwaysSentFields: logrus.Fields{},
+		MaxSendRetries:   2,
+		IncludeEventID:   true,
+	}
+
+	entryTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Time: entryTime}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ids []string
+	for _, attempt := range attempts {
+		var res map[string]string
+		if err := json.Unmarshal(attempt, &res); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, res["event_id"])
+	}
+	if len(ids) != 4 || ids[0] == "" || ids[0] != ids[1] || ids[1] != ids[2] {
+		t.Errorf("expected the same event ID in all attempts to send the entry but got %v", ids)
+	}
+	if ids[3] == ids[0] {
+		t.Errorf("expected identical entry fired again to get another event ID but got %v", ids)
+	}
+
+	attempts = nil
+	hook.EventIDKey = "id"
+	hook.EventIDFunc = func(entry *logrus.Entry) string {
+		return entry.Data["request_id"].(string)
+	}
+	entry := &logrus.Entry{Message: "hello", Data: logrus.Fields{"request_id": "req-1"}}
+	for i := 0; i < 2; i++ {
+		if err := hook.Fire(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, attempt := range attempts {
+		var res map[string]string
+		if err := json.Unmarshal(attempt, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res["id"] != "req-1" {
+			t.Errorf("expected event ID from EventIDFunc but got '%v'", res)
+		}
+	}
+}
+
+func TestFireWithUptime(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.IncludeUptime = true
+	hook.UptimeKey = "up"
+
+	var uptimes []float64
+	for i := 0; i < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]interface{}
+		if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		uptime, ok := res["up"].(float64)
+		if !ok {
+			t.Fatalf("expected uptime to be a number but got '%v'", res["up"])
+		}
+		uptimes = append(uptimes, uptime)
+	}
+
+	if uptimes[0] < 10 || uptimes[1] < uptimes[0]+10 {
+		t.Errorf("expected uptime to increase between entries but got %v", uptimes)
+	}
+}
+
+type LocalAddrConnMock struct {
+	ConnMock
+	addr net.Addr
+}
+
+func (c LocalAddrConnMock) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func TestFireWithLocalAddr(t *testing.T) {
+	buff := bytes.NewBufferString("")
+	hook := &Hook{
+		conn:             LocalAddrConnMock{ConnMock{buff}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}},
+		alwaysSentFields: logrus.Fields{},
+		IncludeLocalAddr: true,
+	}
+
+	for _, expected := range []string{"10.0.0.1:40000", "10.0.1.1:50000"} {
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]string
+		if err := json.NewDecoder(buff).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res["net.local_addr"] != expected {
+			t.Errorf("expected net.local_addr to be '%s' but got '%s'", expected, res["net.local_addr"])
+		}
+
+		// Reconnect from another address.
+		hook.setConn(LocalAddrConnMock{ConnMock{buff}, &net.TCPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 50000}})
+	}
+}
+
+func TestLevelGatedFields(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{"request_body": "{}", "service": "shop"},
+	}
+	hook.AddFieldProvider(func() (string, interface{}) {
+		return "headers", "Accept: */*"
+	})
+	hook.SetFieldLevel("request_body", logrus.ErrorLevel)
+	hook.SetFieldLevel("headers", logrus.ErrorLevel)
+
+	for _, level := range []logrus.Level{logrus.InfoLevel, logrus.ErrorLevel, logrus.FatalLevel} {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Level: level}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]string
+		if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		_, hasBody := res["request_body"]
+		_, hasHeaders := res["headers"]
+		if gated := level > logrus.ErrorLevel; hasBody == gated || hasHeaders == gated {
+			t.Errorf("expected level-gated fields to be sent with %s entries only at error level or above but got '%v'", level, res)
+		}
+		if res["service"] != "shop" {
+			t.Errorf("expected service to be sent with %s entries but got '%v'", level, res)
+		}
+	}
+}
+
+type AliveConnMock struct {
+	ConnMock
+}
+
+func (c AliveConnMock) Read(b []byte) (int, error) {
+	return 0, netErrorMock{timeout: true}
+}
+
+func TestHealthCheckReconnects(t *testing.T) {
+	dials := make(chan struct{}, 1)
+	alive := AliveConnMock{ConnMock{buff: bytes.NewBufferString("")}}
+	hook := &Hook{
+		// Empty buffer makes reads return EOF like a connection closed by logstash.
+		conn:                ConnMock{buff: bytes.NewBufferString("")},
+		alwaysSentFields:    logrus.Fields{},
+		protocol:            "tcp",
+		address:             "localhost:9999",
+		HealthCheckInterval: 10 * time.Millisecond,
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			dials <- struct{}{}
+			return alive, nil
+		},
+	}
+	hook.StartHealthCheck()
+	defer hook.Close()
+
+	select {
+	case <-dials:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected health check to reconnect dead connection")
+	}
+
+	// The new connection is alive, so the hook doesn't reconnect again.
+	select {
+	case <-dials:
+		t.Error("expected health check to not reconnect live connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	hook.RLock()
+	defer hook.RUnlock()
+	if hook.conn != alive {
+		t.Errorf("expected hook to use new connection but got %v", hook.conn)
+	}
+}
+
+func TestHealthCheckWaitsForReconnect(t *testing.T) {
+	var dials int
+	hook := &Hook{
+		conn:             ConnMock{buff: bytes.NewBufferString("")},
+		alwaysSentFields: logrus.Fields{},
+		protocol:         "tcp",
+		address:          "localhost:9999",
+		dialFunc: func(protocol, address string) (net.Conn, error) {
+			dials++
+			return AliveConnMock{ConnMock{buff: bytes.NewBufferString("")}}, nil
+		},
+	}
+
+	// Reconnect after failed send is in progress.
+	if !hook.startReconnect(false) {
+		t.Fatal("expected reconnect to start")
+	}
+	hook.checkHealth(make(chan struct{}))
+	if dials != 0 {
+		t.Errorf("expected health check to not reconnect concurrently but got %d dials", dials)
+	}
+
+	hook.finishReconnect()
+	hook.checkHealth(make(chan struct{}))
+	if dials != 1 || hook.isReconnecting() {
+		t.Errorf("expected health check to reconnect once and finish but got %d dials", dials)
+	}
+}
+
+func TestSetFormatter(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Formatter = &LogstashFormatter{}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hook.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true, DisableColors: true})
+	}()
+	if err := hook.Fire(&logrus.Entry{Message: "during swap", Level: logrus.InfoLevel}); err != nil {
+		t.Error(err)
+	}
+	<-done
+	conn.buff.Reset()
+
+	if err := hook.Fire(&logrus.Entry{Message: "after swap", Level: logrus.InfoLevel}); err != nil {
+		t.Error(err)
+	}
+	if expected := "level=info msg=\"after swap\"\n"; conn.buff.String() != expected {
+		t.Errorf("expected entry to be formatted with new formatter as '%s' but got '%s'", expected, conn.buff)
+	}
+	conn.buff.Reset()
+
+	hook.SetFormatter(nil)
+	if err := hook.Fire(&logrus.Entry{Message: "restored"}); err != nil {
+		t.Error(err)
+	}
+	var res map[string]string
+	if err := json.Unmarshal(conn.buff.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "restored" || res["type"] != "bob" {
+		t.Errorf("expected entry to be formatted with LogstashFormatter but got '%v'", res)
+	}
+}
+
+func TestFireWithTypeKey(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Formatter = &LogstashFormatter{TypeKey: "service.type"}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["service.type"] != "bob" {
+		t.Errorf("expected app name to be sent as service.type but got '%v'", res)
+	}
+	if _, ok := res["type"]; ok {
+		t.Errorf("expected type to not be sent but got '%v'", res)
+	}
+}
+
+func TestFireWithTypeRouter(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.TypeRouter = func(entry *logrus.Entry) string {
+		stream, _ := entry.Data["stream"].(string)
+		return stream
+	}
+
+	for _, te := range []struct {
+		fields   logrus.Fields
+		expected string
+	}{
+		{logrus.Fields{"stream": "access"}, "access"},
+		{logrus.Fields{"stream": "audit"}, "audit"},
+		{logrus.Fields{}, "bob"},
+	} {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Data: te.fields}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]string
+		if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res["type"] != te.expected {
+			t.Errorf("expected type to be '%s' but got '%s'", te.expected, res["type"])
+		}
+	}
+}
+
+func TestFireWithTypeOverride(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Formatter = &LogstashFormatter{TypeOverrideKey: "@type"}
+
+	for _, te := range []struct {
+		fields   logrus.Fields
+		expected string
+	}{
+		{logrus.Fields{"@type": "audit"}, "audit"},
+		{logrus.Fields{}, "bob"},
+		{logrus.Fields{"@type": ""}, "bob"},
+	} {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Data: te.fields}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]string
+		if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res["type"] != te.expected {
+			t.Errorf("expected type to be '%s' but got '%s'", te.expected, res["type"])
+		}
+		if _, ok := res["@type"]; ok {
+			t.Errorf("expected @type to not be sent but got '%v'", res)
+		}
+	}
+}
+
+func TestFireWithStackTrace(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		StackTraceLevels: []logrus.Level{logrus.ErrorLevel, logrus.PanicLevel},
+	}
+
+	for _, level := range []logrus.Level{logrus.ErrorLevel, logrus.InfoLevel} {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Level: level}); err != nil {
+			t.Error(err)
+		}
+
+		var res map[string]string
+		if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		stack, ok := res["stack_trace"]
+		if level == logrus.ErrorLevel && (!strings.HasPrefix(stack, "goroutine ") || !strings.Contains(stack, "TestFireWithStackTrace")) {
+			t.Errorf("expected stack trace of the test to be sent with error entry but got '%s'", stack)
+		}
+		if level == logrus.InfoLevel && ok {
+			t.Errorf("expected stack trace to not be sent with info entry but got '%s'", stack)
+		}
+	}
+}
+
+func TestFireAfterClose(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		conn := ConnMock{buff: bytes.NewBufferString("")}
+		hook, err := NewHookWithConn(conn, "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if async {
+			hook, err = NewAsyncHookWithConn(conn, "bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			hook.WaitUntilBufferFrees = true
+		}
+
+		if err := hook.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != ErrHookClosed {
+			t.Errorf("expected fire after close to return ErrHookClosed but got: %v", err)
+		}
+		if hook.TryFire(&logrus.Entry{Message: "hello"}) {
+			t.Error("expected try fire after close to return false")
+		}
+		if err := hook.SendRaw([]byte(`{"message":"hello"}`)); err != ErrHookClosed {
+			t.Errorf("expected send raw after close to return ErrHookClosed but got: %v", err)
+		}
+		if conn.buff.Len() != 0 {
+			t.Errorf("expected nothing to be sent after close but got '%s'", conn.buff)
+		}
+	}
+}
+
+func TestWithExpandedFields(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.WithField("host", "web-1")
+	hook.WithExpandedFields(map[string]interface{}{"a.b.c": 1, "a.b.d": "x", "service.name": "shop"})
+	hook.WithExpandedFields(map[string]interface{}{"a.e": true, "host.name": "web-2"})
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello"}); err != nil {
+		t.Error(err)
+	}
+
+	var res map[string]interface{}
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"b": map[string]interface{}{"c": float64(1), "d": "x"},
+		"e": true,
+	}
+	if !reflect.DeepEqual(res["a"], expected) {
+		t.Errorf("expected a to be %v but got '%v'", expected, res["a"])
+	}
+	if !reflect.DeepEqual(res["service"], map[string]interface{}{"name": "shop"}) {
+		t.Errorf("expected service.name to be nested but got '%v'", res["service"])
+	}
+	if res["host"] != "web-1" || res["host.name"] != "web-2" {
+		t.Errorf("expected key conflicting with value to be sent as is but got '%v'", res)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	errRetryable := errors.New("retryable")
+	errReconnect := errors.New("reconnect")
+	errFatal := netErrorMock{}
+
+	tt := []struct {
+		err            error
+		expectedWrites int
+		expectedDials  int
+		expectedErr    bool
+	}{
+		{errRetryable, 3, 0, true},
+		{errReconnect, 1, 1, false},
+		{errFatal, 1, 0, true},
+	}
+
+	for _, te := range tt {
+		var writes, dials int
+		conn := ConnMock{buff: bytes.NewBufferString("")}
+		hook := &Hook{
+			conn:                FailingConnMock{err: te.err, writes: &writes},
+			alwaysSentFields:    logrus.Fields{},
+			protocol:            "tcp",
+			address:             "localhost:9999",
+			MaxSendRetries:      2,
+			MaxReconnectRetries: 1,
+			ClassifyError: func(err error) ErrorClass {
+				switch err {
+				case errRetryable:
+					return ErrorRetryable
+				case errReconnect:
+					return ErrorReconnect
+				default:
+					return ErrorFatal
+				}
+			},
+			dialFunc: func(protocol, address string) (net.Conn, error) {
+				dials++
+				return conn, nil
+			},
+		}
+
+		err := hook.Fire(&logrus.Entry{Message: "hello"})
+		if (err != nil) != te.expectedErr {
+			t.Errorf("expected %s to return error %t but got: %v", te.err, te.expectedErr, err)
+		}
+		if writes != te.expectedWrites || dials != te.expectedDials {
+			t.Errorf("expected %s to make %d writes and %d dials but got %d and %d",
+				te.err, te.expectedWrites, te.expectedDials, writes, dials)
+		}
+		if sent := conn.buff.Len() > 0; sent == te.expectedErr {
+			t.Errorf("expected %s to send message over new connection %t", te.err, !te.expectedErr)
+		}
+	}
+}
+
+func TestFireWithEnvelope(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.EnvelopeKey = "log"
+	hook.EnvelopeFields = logrus.Fields{"tenant_id": "default", "cluster": "eu-1"}
+	hook.EnvelopeProvider = func() logrus.Fields {
+		return logrus.Fields{"tenant_id": "acme"}
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{"user": "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var res struct {
+		TenantID string            `json:"tenant_id"`
+		Cluster  string            `json:"cluster"`
+		Log      map[string]string `json:"log"`
+	}
+	b := conn.buff.Bytes()
+	if !bytes.HasSuffix(b, []byte("}\n")) {
+		t.Errorf("expected envelope to end with newline but got '%s'", b)
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.TenantID != "acme" || res.Cluster != "eu-1" {
+		t.Errorf("expected envelope fields at top level but got tenant '%s' and cluster '%s'", res.TenantID, res.Cluster)
+	}
+	if res.Log["message"] != "hello" || res.Log["type"] != "bob" || res.Log["user"] != "alice" {
+		t.Errorf("expected document under log key but got '%v'", res.Log)
+	}
+}
+
+func TestFireWithCompressMinSize(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Compress = true
+	hook.CompressMinSize = 1024
+
+	// Gzip output may contain newlines, so compressed messages must be length prefixed.
+	if err := hook.Fire(&logrus.Entry{Message: "small"}); err != errCompressFraming {
+		t.Errorf("expected fire with newline framing to return '%v' but got '%v'", errCompressFraming, err)
+	}
+	if _, err := New(Config{Conn: conn, Compress: true}); err == nil {
+		t.Error("expected new to return error for compressed hook with newline framing")
+	}
+
+	hook.Framing = LengthPrefixFraming
+	message := strings.Repeat("large ", 500)
+	for _, m := range []string{"small", message} {
+		if err := hook.Fire(&logrus.Entry{Message: m}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readFrame := func() []byte {
+		size := binary.BigEndian.Uint32(conn.buff.Next(4))
+		return conn.buff.Next(int(size))
+	}
+
+	var res map[string]string
+	if err := json.Unmarshal(readFrame(), &res); err != nil || res["message"] != "small" {
+		t.Errorf("expected small message to be sent uncompressed but got '%v'", res)
+	}
+
+	frame := readFrame()
+	if len(frame) >= len(message) || conn.buff.Len() != 0 {
+		t.Errorf("expected large message to be compressed inside its frame but got %d bytes", len(frame))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewDecoder(zr).Decode(&res); err != nil || res["message"] != message {
+		t.Errorf("expected large message to be sent compressed but got '%v'", res)
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	var deadLetters []string
+	hook := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		DeadLetter: func(entry *logrus.Entry, err error) {
+			deadLetters = append(deadLetters, entry.Message)
+		},
+	}
+
+	var calls []string
+	hook.Use(func(entry *logrus.Entry) (*logrus.Entry, error) {
+		calls = append(calls, "redact")
+		if entry.Message == "debug noise" {
+			return nil, nil
+		}
+		if entry.Message == "broken" {
+			return nil, errors.New("broken entry")
+		}
+		entry.Data["password"] = "***"
+		return entry, nil
+	})
+	hook.Use(func(entry *logrus.Entry) (*logrus.Entry, error) {
+		calls = append(calls, "upper")
+		entry.Data["user"] = strings.ToUpper(entry.Data["user"].(string))
+		return entry, nil
+	})
+
+	if err := hook.Fire(&logrus.Entry{Message: "login", Data: logrus.Fields{"user": "alice", "password": "secret"}}); err != nil {
+		t.Error(err)
+	}
+	if err := hook.Fire(&logrus.Entry{Message: "debug noise"}); err != nil {
+		t.Error(err)
+	}
+	if err := hook.Fire(&logrus.Entry{Message: "broken"}); err == nil {
+		t.Error("expected fire to return middleware error")
+	}
+
+	expectedCalls := []string{"redact", "upper", "redact", "redact"}
+	if !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("expected middlewares to be called as %v but got %v", expectedCalls, calls)
+	}
+	if !reflect.DeepEqual(deadLetters, []string{"broken"}) {
+		t.Errorf("expected broken entry to be dead lettered but got %v", deadLetters)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["message"] != "login" || res["user"] != "ALICE" || res["password"] != "***" {
+		t.Errorf("expected transformed entry to be sent but got '%v'", res)
+	}
+	if conn.buff.Len() > 1 {
+		t.Errorf("expected dropped entries to not be sent but got '%s'", conn.buff)
+	}
+}
+
+func TestNewHookDialsTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	// The test server certificate isn't trusted, so the handshake fails after the TLS connection is dialed.
+	_, err := NewHook("tls", server.Listener.Addr().String(), "bob")
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected constructor to dial logstash over TLS but got: %v", err)
+	}
+}
+
+func TestMiddlewareNewEntryFilterHookOnly(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithFieldsAndConnAndPrefix(conn, "bob", logrus.Fields{}, "_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var transformed *logrus.Entry
+	hook.Use(func(entry *logrus.Entry) (*logrus.Entry, error) {
+		transformed = entry.WithField("_trace", "abc")
+		return transformed, nil
+	})
+
+	entry := &logrus.Entry{Message: "hello", Data: logrus.Fields{"_user": "alice"}}
+	if err := hook.Fire(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]string
+	if err := json.NewDecoder(conn.buff).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["user"] != "alice" || res["trace"] != "abc" {
+		t.Errorf("expected hook only fields to be sent but got '%v'", res)
+	}
+	if len(entry.Data) != 0 || len(transformed.Data) != 0 {
+		t.Errorf("expected hook only fields to be removed from fired and transformed entries but got %v and %v",
+			entry.Data, transformed.Data)
+	}
+}
@@ -0,0 +1,202 @@
+package logrustash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BinaryFormatter encodes documents of a JSON formatter with a binary codec, MessagePack by default.
+// Binary documents may contain newlines, so the hook must use LengthPrefixFraming.
+type BinaryFormatter struct {
+	Formatter logrus.Formatter                    // Formats JSON documents. LogstashFormatter is used if it is nil.
+	Marshal   func(v interface{}) ([]byte, error) // Encodes the document, e.g. with CBOR. MarshalMessagePack is used if it is nil.
+}
+
+// Format formats log message.
+func (f *BinaryFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return f.FormatWithPrefix(entry, "")
+}
+
+// FormatWithPrefix removes prefix from keys and formats log message.
+// Newline is appended to the binary document like to JSON ones, LengthPrefixFraming removes it.
+func (f *BinaryFormatter) FormatWithPrefix(entry *logrus.Entry, prefix string) ([]byte, error) {
+	formatter := f.Formatter
+	if formatter == nil {
+		formatter = &LogstashFormatter{}
+	}
+
+	var document []byte
+	var err error
+	if pf, ok := formatter.(prefixFormatter); ok {
+		document, err = pf.FormatWithPrefix(entry, prefix)
+	} else {
+		document, err = formatter.Format(entry)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Numbers are decoded as json.Number, so integers aren't encoded as floats.
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(document))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("Failed to decode document, %v", err)
+	}
+
+	marshal := f.Marshal
+	if marshal == nil {
+		marshal = MarshalMessagePack
+	}
+	encoded, err := marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode document, %v", err)
+	}
+
+	return append(encoded, '\n'), nil
+}
+
+// MarshalMessagePack encodes v with MessagePack. It supports nil, booleans, numbers including json.Number,
+// strings, byte slices, slices and maps with string keys. Map keys are sorted, so the encoding is deterministic.
+func MarshalMessagePack(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeMessagePack(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func encodeMessagePack(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+
+	if n, ok := v.Interface().(json.Number); ok {
+		return encodeNumber(buf, n)
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return encodeMessagePack(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		encodeInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		encodeUint(buf, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v.Float()))
+	case reflect.String:
+		encodeString(buf, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			encodeBytes(buf, v.Bytes())
+			return nil
+		}
+		encodeLength(buf, v.Len(), 0x90, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeMessagePack(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("MessagePack encoder doesn't support map keys of type %s", v.Type().Key())
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+		encodeLength(buf, len(keys), 0x80, 0xdf)
+		for _, k := range keys {
+			encodeString(buf, k.String())
+			if err := encodeMessagePack(buf, v.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("MessagePack encoder doesn't support type %s", v.Type())
+	}
+
+	return nil
+}
+
+func encodeNumber(buf *bytes.Buffer, n json.Number) error {
+	if i, err := n.Int64(); err == nil {
+		encodeInt(buf, i)
+		return nil
+	}
+	if f, err := n.Float64(); err == nil {
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		return nil
+	}
+
+	return fmt.Errorf("Invalid number %s", n)
+}
+
+func encodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		encodeUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func encodeUint(buf *bytes.Buffer, u uint64) {
+	if u < 128 {
+		buf.WriteByte(byte(u))
+		return
+	}
+
+	buf.WriteByte(0xcf)
+	binary.Write(buf, binary.BigEndian, u)
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	if len(s) < 32 {
+		buf.WriteByte(0xa0 | byte(len(s)))
+	} else {
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	}
+	buf.WriteString(s)
+}
+
+func encodeBytes(buf *bytes.Buffer, b []byte) {
+	buf.WriteByte(0xc6)
+	binary.Write(buf, binary.BigEndian, uint32(len(b)))
+	buf.Write(b)
+}
+
+// encodeLength writes length of array or map in fix format if it fits, otherwise in 32-bit format.
+func encodeLength(buf *bytes.Buffer, n int, fix, long byte) {
+	if n < 16 {
+		buf.WriteByte(fix | byte(n))
+		return
+	}
+
+	buf.WriteByte(long)
+	binary.Write(buf, binary.BigEndian, uint32(n))
+}
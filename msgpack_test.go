@@ -0,0 +1,177 @@
+package logrustash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// decodeMessagePack decodes formats written by MarshalMessagePack.
+func decodeMessagePack(r *bytes.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	readLength := func() (int, error) {
+		var n uint32
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int(n), err
+	}
+	readString := func(n int) (string, error) {
+		s := make([]byte, n)
+		_, err := io.ReadFull(r, s)
+		return string(s), err
+	}
+
+	switch {
+	case b < 0x80:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return readString(int(b & 0x1f))
+	case b&0xf0 == 0x90, b == 0xdd:
+		n := int(b & 0x0f)
+		if b == 0xdd {
+			if n, err = readLength(); err != nil {
+				return nil, err
+			}
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = decodeMessagePack(r); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case b&0xf0 == 0x80, b == 0xdf:
+		n := int(b & 0x0f)
+		if b == 0xdf {
+			if n, err = readLength(); err != nil {
+				return nil, err
+			}
+		}
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k, err := decodeMessagePack(r)
+			if err != nil {
+				return nil, err
+			}
+			if m[k.(string)], err = decodeMessagePack(r); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2, 0xc3:
+		return b == 0xc3, nil
+	case 0xcb:
+		var u uint64
+		err := binary.Read(r, binary.BigEndian, &u)
+		return math.Float64frombits(u), err
+	case 0xcf:
+		var u uint64
+		err := binary.Read(r, binary.BigEndian, &u)
+		return u, err
+	case 0xd3:
+		var i int64
+		err := binary.Read(r, binary.BigEndian, &i)
+		return i, err
+	case 0xdb:
+		n, err := readLength()
+		if err != nil {
+			return nil, err
+		}
+		return readString(n)
+	case 0xc6:
+		n, err := readLength()
+		if err != nil {
+			return nil, err
+		}
+		s, err := readString(n)
+		return []byte(s), err
+	}
+
+	return nil, fmt.Errorf("unexpected byte %#x", b)
+}
+
+func TestMarshalMessagePack(t *testing.T) {
+	value := map[string]interface{}{
+		"nil":    nil,
+		"bool":   true,
+		"small":  int64(10),
+		"neg":    int64(-5),
+		"big":    int64(-1 << 40),
+		"uint":   uint64(math.MaxUint64),
+		"float":  1.5,
+		"string": strings.Repeat("s", 40),
+		"bytes":  []byte{'\n', 0},
+		"array":  []interface{}{"a", int64(1), false},
+		"map":    map[string]interface{}{"k": "v"},
+	}
+
+	b, err := MarshalMessagePack(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeMessagePack(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, value) {
+		t.Errorf("expected %v to be decoded but got %v", value, decoded)
+	}
+
+	if _, err := MarshalMessagePack(map[int]string{1: "a"}); err == nil {
+		t.Error("expected map with int keys to be rejected")
+	}
+}
+
+func TestFireWithBinaryFormatter(t *testing.T) {
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Formatter = &BinaryFormatter{Formatter: &LogstashFormatter{Type: "bob"}}
+
+	entry := &logrus.Entry{Message: "hello\nworld", Data: logrus.Fields{"count": 10, "ratio": 0.5}}
+	if err := hook.Fire(entry); err == nil {
+		t.Error("expected binary document to be rejected with newline framing")
+	}
+
+	hook.Framing = LengthPrefixFraming
+	if err := hook.Fire(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	var length uint32
+	if err := binary.Read(conn.buff, binary.BigEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	if int(length) != conn.buff.Len() {
+		t.Fatalf("expected frame of %d bytes but got %d", conn.buff.Len(), length)
+	}
+
+	decoded, err := decodeMessagePack(bytes.NewReader(conn.buff.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, _ := decoded.(map[string]interface{})
+	if doc["message"] != "hello\nworld" || doc["type"] != "bob" || doc["count"] != int64(10) || doc["ratio"] != 0.5 {
+		t.Errorf("expected entry to be decoded from MessagePack but got %v", decoded)
+	}
+}
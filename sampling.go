@@ -0,0 +1,78 @@
+package logrustash
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FirstThenSampler keeps the first entry with a key and samples the following ones until Window elapses,
+// e.g. to see the first of repeated errors immediately without flooding logstash. Pass Sample to Hook.Use:
+//
+//	sampler := &logrustash.FirstThenSampler{Window: 10 * time.Second, Rate: 0.1}
+//	hook.Use(sampler.Sample)
+type FirstThenSampler struct {
+	Window time.Duration              // Entries with the same key after the first one are sampled for this long.
+	Rate   float64                    // Fraction of sampled entries which are kept, e.g. 0.1. All of them are dropped if zero.
+	Key    func(*logrus.Entry) string // Groups entries. Entries with the same message are grouped if it is nil.
+
+	mu        sync.Mutex
+	windows   map[string]time.Time // Start of the current window per key.
+	lastSweep time.Time
+	now       func() time.Time // Replaces time.Now in tests.
+	random    func() float64   // Replaces rand.Float64 in tests.
+}
+
+// Sample is a hook middleware which drops entries not kept by the sampler.
+func (s *FirstThenSampler) Sample(entry *logrus.Entry) (*logrus.Entry, error) {
+	key := entry.Message
+	if s.Key != nil {
+		key = s.Key(entry)
+	}
+
+	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.windows == nil {
+		s.windows = make(map[string]time.Time)
+	}
+	s.sweep(now)
+
+	start, ok := s.windows[key]
+	if !ok || now.Sub(start) >= s.Window {
+		s.windows[key] = now
+		return entry, nil
+	}
+
+	random := rand.Float64
+	if s.random != nil {
+		random = s.random
+	}
+	if random() < s.Rate {
+		return entry, nil
+	}
+
+	return nil, nil
+}
+
+// sweep forgets keys which windows are over at most once per Window, so rare keys don't pile up.
+// It must be called with the sampler locked.
+func (s *FirstThenSampler) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.Window {
+		return
+	}
+	s.lastSweep = now
+
+	for key, start := range s.windows {
+		if now.Sub(start) >= s.Window {
+			delete(s.windows, key)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package logrustash
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestFirstThenSampler(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	randoms := []float64{0.05, 0.5, 0.9, 0.01}
+	sampler := &FirstThenSampler{
+		Window: 10 * time.Second,
+		Rate:   0.1,
+		Key:    func(entry *logrus.Entry) string { return entry.Data["code"].(string) },
+		now:    func() time.Time { return now },
+		random: func() float64 {
+			r := randoms[0]
+			randoms = randoms[1:]
+			return r
+		},
+	}
+
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	hook, err := NewHookWithConn(conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Use(sampler.Sample)
+
+	fire := func(message, code string) {
+		if err := hook.Fire(&logrus.Entry{Message: message, Data: logrus.Fields{"code": code}}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	fire("first", "timeout")   // First in window, kept.
+	fire("kept", "timeout")    // Sampled in with 0.05.
+	fire("dropped", "timeout") // Sampled out with 0.5.
+	fire("other", "refused")   // First with another key, kept.
+	fire("dropped", "refused") // Sampled out with 0.9.
+
+	now = now.Add(10 * time.Second)
+	fire("next window", "timeout") // First in the next window, kept.
+	fire("kept again", "timeout")  // Sampled in with 0.01.
+
+	var messages []string
+	dec := json.NewDecoder(conn.buff)
+	for dec.More() {
+		var res map[string]string
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, res["message"])
+	}
+
+	expected := []string{"first", "kept", "other", "next window", "kept again"}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected messages %v to be sent but got %v", expected, messages)
+	}
+	if len(randoms) != 0 {
+		t.Errorf("expected only entries after the first one to be sampled but %d randoms are left", len(randoms))
+	}
+}
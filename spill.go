@@ -0,0 +1,154 @@
+package logrustash
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+const spillFileName = "logrustash.spill"
+
+// spillHeaderSize is the size of 4-byte big-endian length which precedes each record of the spill file.
+// A record holds data of a single write, e.g. a framed message or a batch.
+const spillHeaderSize = 4
+
+func (h *Hook) spillPath() string {
+	return filepath.Join(h.SpillDir, spillFileName)
+}
+
+// spill appends formatted entry to the spill file instead of dropping it when async buffer is full.
+func (h *Hook) spill(entry *logrus.Entry) {
+	data, err := h.prepareMessage(entry)
+	if err != nil || data == nil {
+		return
+	}
+
+	if err := h.appendSpill(data); err != nil {
+		fmt.Println("Couldn't spill message to disk:", err)
+	}
+}
+
+// appendSpill appends records to the spill file unless it would grow over SpillMaxBytes.
+func (h *Hook) appendSpill(records ...[]byte) error {
+	var data []byte
+	for _, record := range records {
+		header := make([]byte, spillHeaderSize)
+		binary.BigEndian.PutUint32(header, uint32(len(record)))
+		data = append(append(data, header...), record...)
+	}
+
+	h.spillMu.Lock()
+	defer h.spillMu.Unlock()
+
+	if err := os.MkdirAll(h.SpillDir, 0755); err != nil {
+		return err
+	}
+
+	if h.SpillMaxBytes > 0 {
+		info, err := os.Stat(h.spillPath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		var size int64
+		if info != nil {
+			size = info.Size()
+		}
+		if size+int64(len(data)) > h.SpillMaxBytes {
+			return fmt.Errorf("Spill file reached limit of %d bytes", h.SpillMaxBytes)
+		}
+	}
+
+	f, err := os.OpenFile(h.spillPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	h.spillPending = true
+
+	return f.Close()
+}
+
+// markSpillPending makes the async worker check the spill file before sending next message.
+func (h *Hook) markSpillPending() {
+	if h.SpillDir == "" {
+		return
+	}
+
+	h.spillMu.Lock()
+	h.spillPending = true
+	h.spillMu.Unlock()
+}
+
+// replaySpill sends spilled messages. They are spilled back if sending fails.
+func (h *Hook) replaySpill() {
+	if h.SpillDir == "" || h.isReconnecting() {
+		return
+	}
+
+	h.spillMu.Lock()
+	if !h.spillChecked {
+		// Messages may be left on disk by the previous run.
+		h.spillPending = true
+		h.spillChecked = true
+	}
+	if !h.spillPending {
+		h.spillMu.Unlock()
+		return
+	}
+	h.spillPending = false
+
+	data, err := ioutil.ReadFile(h.spillPath())
+	if err == nil {
+		err = os.Remove(h.spillPath())
+	}
+	h.spillMu.Unlock()
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Couldn't read spilled messages:", err)
+		}
+		return
+	}
+	records, err := splitSpill(data)
+	if err != nil {
+		fmt.Println("Couldn't read spilled messages:", err)
+	}
+
+	// Records are sent one by one as they were written, the rest is spilled back after the first failure.
+	for i, record := range records {
+		if err := h.sendWithRetries(context.Background(), record, nil); err != nil {
+			fmt.Println("Error during sending spilled messages to logstash:", err)
+			if err := h.appendSpill(records[i:]...); err != nil {
+				fmt.Println("Couldn't spill message to disk:", err)
+			}
+			return
+		}
+	}
+}
+
+// splitSpill splits content of the spill file to records. Records read before a truncated one are returned with error.
+func splitSpill(data []byte) ([][]byte, error) {
+	var records [][]byte
+	for len(data) > 0 {
+		if len(data) < spillHeaderSize {
+			return records, fmt.Errorf("Spill file has truncated record")
+		}
+		size := binary.BigEndian.Uint32(data)
+		data = data[spillHeaderSize:]
+		if uint64(len(data)) < uint64(size) {
+			return records, fmt.Errorf("Spill file has truncated record")
+		}
+		records = append(records, data[:size])
+		data = data[size:]
+	}
+
+	return records, nil
+}
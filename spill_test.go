@@ -0,0 +1,160 @@
+package logrustash
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSpillOverflowAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrustash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// No worker reads the buffer, so messages after the first one overflow it.
+	hook := &Hook{
+		conn:             ConnMock{buff: bytes.NewBufferString("")},
+		alwaysSentFields: logrus.Fields{},
+		fireChannel:      make(chan bufferedEntry, 1),
+		SpillDir:         dir,
+	}
+	for _, message := range []string{"buffered", "first", "second"} {
+		if err := hook.Fire(&logrus.Entry{Message: message}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	spilled, err := ioutil.ReadFile(filepath.Join(dir, spillFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := splitSpill(spilled)
+	if err != nil || len(records) != 2 || !strings.Contains(string(records[0]), `"first"`) || !strings.Contains(string(records[1]), `"second"`) {
+		t.Errorf("expected 2 overflowed messages to be spilled but got '%s', error: %v", spilled, err)
+	}
+
+	// Spilled messages are sent when the next async worker starts.
+	conn := ConnMock{buff: bytes.NewBufferString("")}
+	restarted := &Hook{
+		conn:             conn,
+		alwaysSentFields: logrus.Fields{},
+		SpillDir:         dir,
+	}
+	restarted.makeAsync()
+	restarted.Close()
+
+	if res := conn.buff.String(); res != string(records[0])+string(records[1]) {
+		t.Errorf("expected spilled messages to be replayed but got '%s'", res)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spillFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected spill file to be removed after replay but got: %v", err)
+	}
+}
+
+func TestSpillMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrustash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each record takes 4 more bytes for its length.
+	hook := &Hook{SpillDir: dir, SpillMaxBytes: 16}
+	if err := hook.appendSpill([]byte("12345678\n")); err != nil {
+		t.Errorf("expected message to be spilled but got: %s", err)
+	}
+	if err := hook.appendSpill([]byte("12\n")); err == nil {
+		t.Error("expected message over the limit to be rejected")
+	}
+}
+
+type WritesConnMock struct {
+	ConnMock
+	writes *[]string
+}
+
+func (c WritesConnMock) Write(b []byte) (int, error) {
+	*c.writes = append(*c.writes, string(b))
+	return len(b), nil
+}
+
+func TestSpillReplayByRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrustash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var writes []string
+	hook := &Hook{
+		conn:             WritesConnMock{writes: &writes},
+		alwaysSentFields: logrus.Fields{},
+		SpillDir:         dir,
+		Framing:          JSONArrayFraming,
+		MaxLineBytes:     20,
+	}
+	for _, record := range []string{`[{"a":1},{"b":2}]`, `[{"c":3}]`} {
+		if err := hook.appendSpill([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hook.replaySpill()
+
+	// Each write is a valid JSON array within MaxLineBytes.
+	if !reflect.DeepEqual(writes, []string{`[{"a":1},{"b":2}]`, `[{"c":3}]`}) {
+		t.Errorf("expected spilled records to be sent one by one but got %q", writes)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spillFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected spill file to be removed after replay but got: %v", err)
+	}
+}
+
+func TestSpillReplayFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrustash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writes := 0
+	hook := &Hook{
+		conn:             FailingConnMock{err: errors.New("broken pipe"), writes: &writes},
+		alwaysSentFields: logrus.Fields{},
+		SpillDir:         dir,
+		Backoff:          &backoffMock{},
+	}
+	if err := hook.appendSpill([]byte("first\n"), []byte("second\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	hook.replaySpill()
+
+	spilled, err := ioutil.ReadFile(filepath.Join(dir, spillFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := splitSpill(spilled)
+	if err != nil || len(records) != 2 || string(records[0]) != "first\n" || string(records[1]) != "second\n" {
+		t.Errorf("expected unsent records to be spilled back in order but got %q, error: %v", records, err)
+	}
+}
+
+func TestSplitSpillTruncated(t *testing.T) {
+	records, err := splitSpill([]byte("\x00\x00\x00\x02ab\x00\x00\x00\x05abc"))
+	if err == nil {
+		t.Error("expected truncated record to be reported")
+	}
+	if len(records) != 1 || string(records[0]) != "ab" {
+		t.Errorf("expected complete records to be read but got %q", records)
+	}
+}
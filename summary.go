@@ -0,0 +1,82 @@
+package logrustash
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const summaryMessage = "Log summary"
+
+// StartSummary starts sending an info entry with the number of entries per level fired since the previous
+// summary every SummaryInterval. Counts are sent in level_counts field, e.g. {"error":2,"info":120}.
+// It should be called once after SummaryInterval is set. Close stops sending summaries.
+func (h *Hook) StartSummary() {
+	h.backgroundMu.Lock()
+	defer h.backgroundMu.Unlock()
+
+	if h.SummaryInterval <= 0 || h.summaryStop != nil {
+		return
+	}
+	h.summaryStop = make(chan struct{})
+
+	h.levelCountsMu.Lock()
+	h.levelCounts = make(map[logrus.Level]int)
+	h.levelCountsMu.Unlock()
+
+	newTicker := h.summaryTicker
+	if newTicker == nil {
+		newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+			ticker := time.NewTicker(d)
+			return ticker.C, ticker.Stop
+		}
+	}
+	ticks, stopTicker := newTicker(h.SummaryInterval)
+
+	go func(stop chan struct{}) {
+		defer stopTicker()
+
+		for {
+			select {
+			case now := <-ticks:
+				if err := h.fire(context.Background(), h.summary(now)); err != nil {
+					fmt.Println("Error during sending summary to logstash:", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(h.summaryStop)
+}
+
+// countLevel counts fired entry for the summary.
+func (h *Hook) countLevel(level logrus.Level) {
+	h.levelCountsMu.Lock()
+	defer h.levelCountsMu.Unlock()
+
+	if h.levelCounts != nil {
+		h.levelCounts[level]++
+	}
+}
+
+// summary returns entry with counts of the hook levels and resets them.
+func (h *Hook) summary(now time.Time) *logrus.Entry {
+	h.levelCountsMu.Lock()
+	counts := h.levelCounts
+	h.levelCounts = make(map[logrus.Level]int)
+	h.levelCountsMu.Unlock()
+
+	levelCounts := make(map[string]int)
+	for _, level := range h.Levels() {
+		levelCounts[level.String()] = counts[level]
+	}
+
+	return &logrus.Entry{
+		Time:    now,
+		Level:   logrus.InfoLevel,
+		Message: summaryMessage,
+		Data:    logrus.Fields{"level_counts": levelCounts},
+	}
+}
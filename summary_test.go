@@ -0,0 +1,79 @@
+package logrustash
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type WriteChanConnMock struct {
+	ConnMock
+	writes chan []byte
+}
+
+func (c WriteChanConnMock) Write(b []byte) (int, error) {
+	c.writes <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestSummary(t *testing.T) {
+	writes := make(chan []byte, 10)
+	ticks := make(chan time.Time)
+	hook, err := NewHookWithConn(WriteChanConnMock{ConnMock{buff: bytes.NewBufferString("")}, writes}, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.SummaryInterval = time.Minute
+	hook.summaryTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		if d != time.Minute {
+			t.Errorf("expected ticker with interval '%s' but got '%s'", time.Minute, d)
+		}
+		return ticks, func() {}
+	}
+	hook.StartSummary()
+	defer hook.Close()
+
+	summary := func(now time.Time) map[string]interface{} {
+		ticks <- now
+		for b := range writes {
+			var res map[string]interface{}
+			if err := json.Unmarshal(b, &res); err != nil {
+				t.Fatal(err)
+			}
+			if res["message"] == summaryMessage {
+				return res
+			}
+		}
+		return nil
+	}
+
+	for _, level := range []logrus.Level{logrus.InfoLevel, logrus.InfoLevel, logrus.ErrorLevel, logrus.InfoLevel} {
+		if err := hook.Fire(&logrus.Entry{Message: "hello", Level: level}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	now := time.Date(2020, 1, 1, 0, 1, 0, 0, time.UTC)
+	res := summary(now)
+	expected := map[string]interface{}{"panic": 0.0, "fatal": 0.0, "error": 1.0, "warning": 0.0, "info": 3.0, "debug": 0.0}
+	if !reflect.DeepEqual(res["level_counts"], expected) {
+		t.Errorf("expected level counts to be %v but got '%v'", expected, res["level_counts"])
+	}
+	if res["@timestamp"] != now.Format(time.RFC3339) || res["level"] != "info" {
+		t.Errorf("expected info summary at the tick time but got '%v'", res)
+	}
+
+	// Counts are reset after each summary and summaries aren't counted.
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Level: logrus.WarnLevel}); err != nil {
+		t.Error(err)
+	}
+	res = summary(now.Add(time.Minute))
+	expected = map[string]interface{}{"panic": 0.0, "fatal": 0.0, "error": 0.0, "warning": 1.0, "info": 0.0, "debug": 0.0}
+	if !reflect.DeepEqual(res["level_counts"], expected) {
+		t.Errorf("expected level counts to be %v but got '%v'", expected, res["level_counts"])
+	}
+}
@@ -0,0 +1,99 @@
+package logrustash
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// hookURL holds connection settings parsed from a logstash URL.
+type hookURL struct {
+	protocol   string
+	address    string
+	timeout    time.Duration
+	async      bool
+	bufferSize int
+}
+
+// NewHookFromURL creates a new hook to a Logstash instance described by URL like
+// tcp://logstash:5000 or tls://logstash:5044?timeout=5s&async=true&buffer_size=1024.
+// Supported schemes are tcp, udp and tls. Query parameters set Timeout, make the hook async
+// and set AsyncBufferSize of the async hook (8192 by default).
+func NewHookFromURL(rawurl, appName string) (*Hook, error) {
+	u, err := parseHookURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	hook := &Hook{
+		protocol:         u.protocol,
+		address:          u.address,
+		appName:          appName,
+		alwaysSentFields: make(logrus.Fields),
+		created:          time.Now(),
+		Timeout:          u.timeout,
+	}
+	conn, err := hook.dial()
+	if err != nil {
+		return nil, err
+	}
+	hook.setConn(conn)
+
+	if u.async {
+		hook.AsyncBufferSize = 8192
+		if u.bufferSize > 0 {
+			hook.AsyncBufferSize = u.bufferSize
+		}
+		hook.makeAsync()
+	}
+
+	return hook, nil
+}
+
+func parseHookURL(rawurl string) (*hookURL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid logstash URL: %v", err)
+	}
+
+	switch u.Scheme {
+	case "tcp", "udp", "tls":
+	default:
+		return nil, fmt.Errorf("Unsupported logstash URL scheme %q", u.Scheme)
+	}
+
+	if _, port, err := net.SplitHostPort(u.Host); err != nil || port == "" {
+		return nil, fmt.Errorf("Logstash URL %q must have host and port", rawurl)
+	}
+
+	parsed := &hookURL{protocol: u.Scheme, address: u.Host}
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "timeout":
+			parsed.timeout, err = time.ParseDuration(value)
+		case "async":
+			parsed.async, err = strconv.ParseBool(value)
+		case "buffer_size":
+			parsed.bufferSize, err = strconv.Atoi(value)
+			if err == nil && parsed.bufferSize < 0 {
+				err = fmt.Errorf("negative size")
+			}
+		default:
+			return nil, fmt.Errorf("Unknown logstash URL parameter %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid logstash URL parameter %s=%q: %v", key, value, err)
+		}
+	}
+
+	if parsed.bufferSize > 0 && !parsed.async {
+		return nil, fmt.Errorf("Logstash URL parameter buffer_size requires async=true")
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,100 @@
+package logrustash
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseHookURL(t *testing.T) {
+	tt := []struct {
+		rawurl   string
+		expected *hookURL
+	}{
+		{"tcp://logstash:5000", &hookURL{protocol: "tcp", address: "logstash:5000"}},
+		{"udp://127.0.0.1:5000?timeout=1s", &hookURL{protocol: "udp", address: "127.0.0.1:5000", timeout: time.Second}},
+		{"tls://[::1]:5044?timeout=5s&async=true", &hookURL{protocol: "tls", address: "[::1]:5044", timeout: 5 * time.Second, async: true}},
+		{"tcp://logstash:5000?async=1&buffer_size=16", &hookURL{protocol: "tcp", address: "logstash:5000", async: true, bufferSize: 16}},
+	}
+
+	for _, te := range tt {
+		u, err := parseHookURL(te.rawurl)
+		if err != nil {
+			t.Errorf("expected %s to be parsed but got error: %s", te.rawurl, err)
+			continue
+		}
+		if !reflect.DeepEqual(u, te.expected) {
+			t.Errorf("expected %s to be parsed to %+v but got %+v", te.rawurl, te.expected, u)
+		}
+	}
+}
+
+func TestParseHookURLInvalid(t *testing.T) {
+	for _, rawurl := range []string{
+		"logstash:5000",
+		"http://logstash:5000",
+		"tcp://logstash",
+		"tcp://logstash:",
+		"tcp://%zz:5000",
+		"tcp://logstash:5000?timeout=soon",
+		"tcp://logstash:5000?async=maybe",
+		"tcp://logstash:5000?async=true&buffer_size=-1",
+		"tcp://logstash:5000?buffer_size=16",
+		"tcp://logstash:5000?retries=3",
+	} {
+		if _, err := parseHookURL(rawurl); err == nil {
+			t.Errorf("expected %s to be rejected", rawurl)
+		}
+	}
+}
+
+func TestNewHookFromURL(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b := make([]byte, 1024)
+		n, _ := conn.Read(b)
+		received <- b[:n]
+	}()
+
+	hook, err := NewHookFromURL("tcp://"+ln.Addr().String()+"?timeout=2s&async=true&buffer_size=4", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+
+	if hook.Timeout != 2*time.Second || cap(hook.fireChannel) != 4 {
+		t.Errorf("expected hook to have URL options but got timeout '%s' and buffer size %d", hook.Timeout, cap(hook.fireChannel))
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "hello", Data: logrus.Fields{}}); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case b := <-received:
+		if len(b) == 0 {
+			t.Error("expected message to be sent to logstash")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected message to be sent to logstash")
+	}
+
+	if _, err := NewHookFromURL("ftp://"+ln.Addr().String(), "bob"); err == nil {
+		t.Error("expected hook to not be created for unsupported scheme")
+	}
+}